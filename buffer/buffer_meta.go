@@ -20,6 +20,8 @@ func newMeta() *Meta {
 		PrevLogicalCY:       0, // When the logical number of lines increases
 		ModelineCx:          0, // Number of columns to display
 		Mark:                nil,
+		MarkActive:          false, // Region is active in transient mark mode
+		Cursors:             nil,   // Secondary cursors
 	}
 }
 
@@ -34,6 +36,8 @@ type Meta struct {
 	PrevLogicalCY       int // When the logical number of lines increases
 	ModelineCx          int // Number of columns to display in the modeline
 	Mark                *mark.Mark
+	MarkActive          bool          // Region is active in transient mark mode
+	Cursors             []file.Cursor // Secondary cursors, edited together with Cursor
 
 	StartDrawRowIndex     int
 	StartDrawLogicalIndex int
@@ -2,6 +2,7 @@ package buffer
 
 import (
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"slices"
@@ -43,6 +44,9 @@ func NewBufferSets(paths []string) (bss *BufferSets, errs error) {
 		if mode.IsRegular() {
 			err = buff.Load()
 			buff.SetReadonly(mode.Perm()&0200 == 0)
+			if err == nil {
+				errs = errors.Join(errs, buff.LoadUndo())
+			}
 		} else {
 			continue // such directory or ...
 		}
@@ -51,6 +55,12 @@ func NewBufferSets(paths []string) (bss *BufferSets, errs error) {
 		if err != nil {
 			errs = errors.Join(errs, err)
 		} else {
+			// Edits lost by a crash, restored with Editor.RecoverFile
+			if buff.HasRecovery() {
+				errs = errors.Join(errs, fmt.Errorf("%w %s", pkg_error.ErrorRecovery, buff.GetPath()))
+			} else {
+				errs = errors.Join(errs, buff.RemoveStaleRecovery())
+			}
 			bss.Append(buff)
 		}
 	} // for files
@@ -90,30 +100,99 @@ func (bss *BufferSets) BufferSet(ff *file.File) *bufferSet {
 	return nil
 }
 
-// Find the buffer and meta for filePath from Buffers
+// Find the buffer and meta for filePath from Buffers, a scratch buffer by its name
 // Create a new buffer otherwise
 // Load into buffer if the file exists
 // Register into Buffers
-// Return buffer and meta
+// Return buffer and meta, and pkg_error.ErrorLoadedFile or pkg_error.ErrorNewFile for a new buffer
 func (bss *BufferSets) GetFileAndMeta(filePath string) (*file.File, *Meta, error) {
+	ff, meta, _, err := bss.OpenFileAndMeta(filePath)
+	return ff, meta, err
+}
+
+// OpenFileAndMeta is GetFileAndMeta that also returns the notices about a new buffer:
+// the charset it was decoded from, an undo history that was not restored and a crash-recovery file
+func (bss *BufferSets) OpenFileAndMeta(filePath string) (*file.File, *Meta, []error, error) {
 	for _, buffSet := range *bss {
-		if utils.SameFile(filePath, buffSet.GetPath()) {
-			return buffSet.File, buffSet.PopMeta(), nil
+		if (buffSet.IsScratch() && filePath == buffSet.GetPath()) || utils.SameFile(filePath, buffSet.GetPath()) {
+			return buffSet.File, buffSet.PopMeta(), nil, nil
 		}
 	}
 
 	var err error
+	var notices []error
 	buffSet := newBufferSet(filePath)
 	if err = buffSet.Load(); err != nil {
 		if err = buffSet.New(); err != nil {
-			return buffSet.File, buffSet.PopMeta(), err
+			return buffSet.File, buffSet.PopMeta(), nil, err
 		}
 		err = pkg_error.ErrorNewFile
 	} else {
 		err = pkg_error.ErrorLoadedFile
+		if message := buffSet.GetDecodedMessage(); message != nil {
+			notices = append(notices, message)
+		}
+		if undoErr := buffSet.LoadUndo(); undoErr != nil {
+			notices = append(notices, undoErr)
+		}
+	}
+	if buffSet.HasRecovery() {
+		notices = append(notices, pkg_error.ErrorRecovery)
+	} else if staleErr := buffSet.RemoveStaleRecovery(); staleErr != nil {
+		notices = append(notices, staleErr)
 	}
 	bss.Append(buffSet)
-	return buffSet.File, buffSet.PopMeta(), err
+	return buffSet.File, buffSet.PopMeta(), notices, err
+}
+
+// Create a buffer not backed by a file, such as a diff or search results, from content
+// A scratch buffer of the same name is replaced
+// The buffer is readonly and never saved
+// Return buffer and meta
+func (bss *BufferSets) GetScratchFileAndMeta(name string, content []byte) (*file.File, *Meta) {
+	buffSet := newBufferSet(name)
+	for _, bs := range *bss {
+		if bs.IsScratch() && bs.GetPath() == buffSet.GetPath() {
+			bss.RemoveByBufferFile(bs.File)
+			break
+		}
+	}
+
+	buffSet.SetContent(content)
+	buffSet.SetScratch(true)
+	buffSet.SetReadonly(true)
+	bss.Append(buffSet)
+	return buffSet.File, buffSet.PopMeta()
+}
+
+// SaveUndo stores the undo histories of the buffers, see file.File.SaveUndo
+func (bss *BufferSets) SaveUndo() (errs error) {
+	for _, buffSet := range *bss {
+		if err := buffSet.SaveUndo(); err != nil {
+			errs = errors.Join(errs, err)
+		}
+	}
+	return errs
+}
+
+// Autosave takes the content of dirty buffers and returns the function writing their crash-recovery files,
+// see file.File.Autosave. nil if there is nothing to write
+func (bss *BufferSets) Autosave() func() error {
+	writes := []func() error{}
+	for _, buffSet := range *bss {
+		if write := buffSet.Autosave(); write != nil {
+			writes = append(writes, write)
+		}
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	return func() (errs error) {
+		for _, write := range writes {
+			errs = errors.Join(errs, write())
+		}
+		return errs
+	}
 }
 
 func (bss *BufferSets) Append(buffSet *bufferSet) {
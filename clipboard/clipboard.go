@@ -0,0 +1,121 @@
+// Package clipboard reads and writes the system clipboard through providers
+// The first readable provider is read, every available provider is written
+package clipboard
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrUnsupported = errors.New("clipboard: reading is not supported")
+
+// Provider is a backend of the system clipboard
+type Provider interface {
+	Name() string
+	Available() bool // Usable in this environment
+	Read() (string, error)
+	Write(s string) error
+}
+
+// Fallback is implemented by a provider written only if no other provider could write
+type Fallback interface {
+	Fallback() bool
+}
+
+func isFallback(p Provider) bool {
+	f, ok := p.(Fallback)
+	return ok && f.Fallback()
+}
+
+var (
+	providers = []Provider{
+		NewSystemProvider(),
+		NewTmuxProvider(),
+		NewOSC52Provider(nil),
+		NewFileProvider(""),
+	}
+	lastText string // Text last written or read, see Changed
+	mutex    sync.RWMutex
+)
+
+// SetProviders sets the providers in the order they are read
+func SetProviders(p ...Provider) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	providers = p
+}
+
+func GetProviders() []Provider {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return providers
+}
+
+// Write writes s to every available provider, to the fallback ones only if no other provider could write it
+// Returns an error only if no provider could write it
+func Write(s string) error {
+	mutex.Lock()
+	lastText = s
+	mutex.Unlock()
+
+	var errs error
+	written := false
+	for _, fallback := range []bool{false, true} {
+		for _, p := range GetProviders() {
+			if isFallback(p) != fallback || !p.Available() {
+				continue
+			}
+			if err := p.Write(s); err != nil {
+				errs = errors.Join(errs, err)
+				continue
+			}
+			written = true
+		}
+		if written {
+			return nil
+		}
+	}
+	if errs == nil {
+		return errors.New("clipboard: no provider is available")
+	}
+	return errs
+}
+
+// Read reads the first available provider that can be read
+func Read() (string, error) {
+	var errs error
+	for _, p := range GetProviders() {
+		if !p.Available() {
+			continue
+		}
+		s, err := p.Read()
+		if errors.Is(err, ErrUnsupported) {
+			continue
+		}
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		mutex.Lock()
+		lastText = s
+		mutex.Unlock()
+		return s, nil
+	}
+	if errs == nil {
+		return "", errors.New("clipboard: no readable provider is available")
+	}
+	return "", errs
+}
+
+// Changed returns the clipboard text if another program put it since the last Write or Read
+func Changed() (string, bool) {
+	mutex.RLock()
+	last := lastText
+	mutex.RUnlock()
+
+	s, err := Read()
+	if err != nil || s == "" || s == last {
+		return "", false
+	}
+	return s, true
+}
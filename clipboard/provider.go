@@ -0,0 +1,152 @@
+package clipboard
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/atotto/clipboard"
+)
+
+// ------------------------------------------------------------------
+// System clipboard by github.com/atotto/clipboard
+// ------------------------------------------------------------------
+
+// Uses pbcopy on macOS, the Windows API, or xclip, xsel and wl-clipboard on Unix
+type systemProvider struct{}
+
+func NewSystemProvider() Provider {
+	return systemProvider{}
+}
+
+func (systemProvider) Name() string { return "system" }
+
+func (systemProvider) Available() bool { return !clipboard.Unsupported }
+
+func (systemProvider) Read() (string, error) { return clipboard.ReadAll() }
+
+func (systemProvider) Write(s string) error { return clipboard.WriteAll(s) }
+
+// ------------------------------------------------------------------
+// tmux buffers
+// ------------------------------------------------------------------
+
+type tmuxProvider struct{}
+
+// Available inside a tmux session
+func NewTmuxProvider() Provider {
+	return tmuxProvider{}
+}
+
+func (tmuxProvider) Name() string { return "tmux" }
+
+func (tmuxProvider) Available() bool {
+	if os.Getenv("TMUX") == "" {
+		return false
+	}
+	_, err := exec.LookPath("tmux")
+	return err == nil
+}
+
+func (tmuxProvider) Read() (string, error) {
+	out, err := exec.Command("tmux", "save-buffer", "-").Output()
+	return string(out), err
+}
+
+func (tmuxProvider) Write(s string) error {
+	cmd := exec.Command("tmux", "load-buffer", "-")
+	cmd.Stdin = strings.NewReader(s)
+	return cmd.Run()
+}
+
+// ------------------------------------------------------------------
+// OSC 52 escape sequence
+// ------------------------------------------------------------------
+
+// Terminals set their clipboard from OSC 52, it works over SSH without X11
+// Reading is not supported, terminals answer it asynchronously if at all
+type osc52Provider struct {
+	out io.Writer
+}
+
+// The sequence is written to out, the controlling terminal if nil
+func NewOSC52Provider(out io.Writer) Provider {
+	return osc52Provider{out: out}
+}
+
+func (osc52Provider) Name() string { return "osc52" }
+
+// Available in SSH sessions and in tmux, or when out is given
+func (p osc52Provider) Available() bool {
+	return p.out != nil || os.Getenv("SSH_TTY") != "" || os.Getenv("SSH_CONNECTION") != "" || os.Getenv("TMUX") != ""
+}
+
+func (osc52Provider) Read() (string, error) { return "", ErrUnsupported }
+
+func (p osc52Provider) Write(s string) error {
+	seq := "\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(s)) + "\a"
+	if os.Getenv("TMUX") != "" {
+		// Passed through tmux to the outer terminal
+		seq = "\x1bPtmux;" + strings.ReplaceAll(seq, "\x1b", "\x1b\x1b") + "\x1b\\"
+	}
+
+	out := p.out
+	if out == nil {
+		tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer tty.Close()
+		out = tty
+	}
+	_, err := io.WriteString(out, seq)
+	return err
+}
+
+// ------------------------------------------------------------------
+// File
+// ------------------------------------------------------------------
+
+// Shares the clipboard between editors on a machine without any other clipboard
+type fileProvider struct {
+	path string
+}
+
+// The default path is clipboard in the user cache directory
+func NewFileProvider(path string) Provider {
+	if path == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			dir = os.TempDir()
+		}
+		path = filepath.Join(dir, "ge-editor", "clipboard")
+	}
+	return fileProvider{path: path}
+}
+
+func (fileProvider) Name() string { return "file" }
+
+func (fileProvider) Available() bool { return true }
+
+// Written only without another clipboard
+func (fileProvider) Fallback() bool { return true }
+
+func (p fileProvider) Read() (string, error) {
+	data, err := os.ReadFile(p.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	return string(data), err
+}
+
+func (p fileProvider) Write(s string) error {
+	if err := os.MkdirAll(filepath.Dir(p.path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(p.path, []byte(s), 0600)
+}
@@ -0,0 +1,245 @@
+// Package diff computes line differences between two texts
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Kind int
+
+const (
+	EQUAL Kind = iota
+	DELETE
+	INSERT
+)
+
+// Line of a hunk
+type Line struct {
+	Kind Kind
+	Text string // Without the line terminator
+}
+
+// Hunk is a group of changes with surrounding context lines
+type Hunk struct {
+	OldStart, OldLines int // 0-based index and number of lines in the old text
+	NewStart, NewLines int // 0-based index and number of lines in the new text
+	Lines              []Line
+}
+
+// Over this number of edits, the part of the texts being searched is reported as replaced at once
+const maxEdits = 10_000
+
+// Lines returns the hunks that change old into new, with context lines around each change
+func Lines(old, new []string, context int) []Hunk {
+	return group(edits(old, new), context)
+}
+
+// Unified formats hunks in the unified diff format
+func Unified(oldName, newName string, hunks []Hunk) string {
+	if len(hunks) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldName, newName)
+	for _, h := range hunks {
+		sb.WriteString(h.Header())
+		sb.WriteByte('\n')
+		for _, l := range h.Lines {
+			sb.WriteByte(" -+"[l.Kind])
+			sb.WriteString(l.Text)
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
+
+// Header returns the range line of the hunk, such as "@@ -1,3 +1,4 @@"
+func (h Hunk) Header() string {
+	return fmt.Sprintf("@@ -%s +%s @@", rangeString(h.OldStart, h.OldLines), rangeString(h.NewStart, h.NewLines))
+}
+
+func rangeString(start, lines int) string {
+	if lines == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, lines)
+}
+
+// edits returns the edit script from old to new with the linear space variant of the Myers algorithm
+func edits(old, new []string) []Line {
+	return appendEdits(make([]Line, 0, len(old)+len(new)), old, new)
+}
+
+// appendEdits appends the edit script from a to b, splitting the texts at the middle snake
+func appendEdits(script []Line, a, b []string) []Line {
+	// Common prefix and suffix are not part of the search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	for _, s := range a[:prefix] {
+		script = append(script, Line{EQUAL, s})
+	}
+	tail := a[len(a)-suffix:]
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(a) > 0 && len(b) > 0 {
+		if x, y, ok := middleSnake(a, b); ok {
+			script = appendEdits(script, a[:x], b[:y])
+			script = appendEdits(script, a[x:], b[y:])
+		} else {
+			script = appendReplace(script, a, b)
+		}
+	} else {
+		script = appendReplace(script, a, b)
+	}
+	for _, s := range tail {
+		script = append(script, Line{EQUAL, s})
+	}
+	return script
+}
+
+// middleSnake searches forward from the start and backward from the end of the texts at once,
+// and returns the point where the two paths meet. a and b must not be empty.
+// ok is false when the texts have nothing in common or need more than maxEdits edits.
+func middleSnake(a, b []string) (x, y int, ok bool) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	forward := make([]int, 2*maxD+2)  // furthest x on each diagonal k, from the start
+	backward := make([]int, 2*maxD+2) // furthest x on each diagonal k, from the end
+	for i := range forward {
+		forward[i] = -1
+		backward[i] = -1
+	}
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+	delta := n - m
+	// With an odd delta the forward path meets the backward path of the same step
+	odd := delta%2 != 0
+	// Diagonals that left the edit graph are skipped
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+
+	for d := 0; d < maxD && d <= maxEdits; d++ {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1] // down, insert
+			} else {
+				x = forward[offset+k-1] + 1 // right, delete
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case odd:
+				if i := offset + delta - k; i >= 0 && i < len(backward) && backward[i] != -1 && x >= n-backward[i] {
+					return x, y, true
+				}
+			}
+		}
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case !odd:
+				if i := offset + delta - k; i >= 0 && i < len(forward) && forward[i] != -1 {
+					fx := forward[i]
+					if fx >= n-x {
+						return fx, fx - (delta - k), true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func appendReplace(script []Line, a, b []string) []Line {
+	for _, s := range a {
+		script = append(script, Line{DELETE, s})
+	}
+	for _, s := range b {
+		script = append(script, Line{INSERT, s})
+	}
+	return script
+}
+
+// group the edit script into hunks, changes at most 2*context lines apart share a hunk
+func group(script []Line, context int) []Hunk {
+	hunks := []Hunk{}
+	var h *Hunk
+	oldIndex, newIndex := 0, 0
+	lastChange := -1 // index in script of the last change of h
+
+	for i, l := range script {
+		if l.Kind != EQUAL {
+			if h == nil || i-lastChange-1 > 2*context {
+				if h != nil {
+					hunks = append(hunks, closeHunk(h, script, lastChange, context))
+				}
+				// Start a new hunk with the preceding context
+				start := max(i-context, lastChange+1, 0)
+				h = &Hunk{OldStart: oldIndex - (i - start), NewStart: newIndex - (i - start)}
+				h.Lines = append(h.Lines, script[start:i]...)
+			} else {
+				h.Lines = append(h.Lines, script[lastChange+1:i]...)
+			}
+			h.Lines = append(h.Lines, l)
+			lastChange = i
+		}
+		switch l.Kind {
+		case EQUAL:
+			oldIndex++
+			newIndex++
+		case DELETE:
+			oldIndex++
+		case INSERT:
+			newIndex++
+		}
+	}
+	if h != nil {
+		hunks = append(hunks, closeHunk(h, script, lastChange, context))
+	}
+	return hunks
+}
+
+// Append the following context and count the lines of the hunk
+func closeHunk(h *Hunk, script []Line, lastChange, context int) Hunk {
+	h.Lines = append(h.Lines, script[lastChange+1:min(lastChange+1+context, len(script))]...)
+	for _, l := range h.Lines {
+		if l.Kind != INSERT {
+			h.OldLines++
+		}
+		if l.Kind != DELETE {
+			h.NewLines++
+		}
+	}
+	return *h
+}
@@ -0,0 +1,142 @@
+package diff
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string // Lines separated by spaces
+		context  int
+		want     string // Hunks in the unified format without the file names
+	}{
+		{"both empty", "", "", 3, ""},
+		{"equal", "a b c", "a b c", 3, ""},
+		{"old empty", "", "a b", 3, "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"new empty", "a b", "", 3, "@@ -1,2 +0,0 @@\n-a\n-b\n"},
+
+		{"prefix only", "x a b c", "a b c", 1, "@@ -1,2 +1,1 @@\n-x\n a\n"},
+		{"suffix only", "a b c", "a b c y", 1, "@@ -3,1 +3,2 @@\n c\n+y\n"},
+		{"prefix and suffix", "x a b c", "a b c y", 1, "@@ -1,2 +1,1 @@\n-x\n a\n@@ -4,1 +3,2 @@\n c\n+y\n"},
+
+		{"contexts overlap", "a b c d e f", "a B c d E f", 2, "@@ -1,6 +1,6 @@\n a\n-b\n+B\n c\n d\n-e\n+E\n f\n"},
+		{"contexts touch", "a b c d e f", "a B c d E f", 1, "@@ -1,6 +1,6 @@\n a\n-b\n+B\n c\n d\n-e\n+E\n f\n"},
+		{"contexts apart", "a b c d e f g", "a B c d e F g", 1, "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n@@ -5,3 +5,3 @@\n e\n-f\n+F\n g\n"},
+
+		{"context 0 replace", "a b c", "a B c", 0, "@@ -2,1 +2,1 @@\n-b\n+B\n"},
+		{"context 0 insert", "a c", "a b c", 0, "@@ -1,0 +2,1 @@\n+b\n"},
+		{"context 0 delete", "a b c", "a c", 0, "@@ -2,1 +1,0 @@\n-b\n"},
+		{"context 0 apart", "a b c d", "A b c D", 0, "@@ -1,1 +1,1 @@\n-a\n+A\n@@ -4,1 +4,1 @@\n-d\n+D\n"},
+		{"insert at the start", "b c", "a b c", 0, "@@ -0,0 +1,1 @@\n+a\n"},
+		{"delete at the end", "a b c", "a b", 0, "@@ -3,1 +2,0 @@\n-c\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hunks := Lines(strings.Fields(tt.old), strings.Fields(tt.new), tt.context)
+			got := strings.TrimPrefix(Unified("a", "b", hunks), "--- a\n+++ b\n")
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Apply the hunks to old as patch does
+func apply(t *testing.T, old []string, hunks []Hunk) []string {
+	t.Helper()
+	result := []string{}
+	next := 0 // Index of the first line of old not copied yet
+	for _, h := range hunks {
+		if h.OldStart < next {
+			t.Fatalf("hunk %s overlaps the previous one", h.Header())
+		}
+		result = append(result, old[next:h.OldStart]...)
+		next = h.OldStart
+		for _, l := range h.Lines {
+			switch l.Kind {
+			case EQUAL, DELETE:
+				if old[next] != l.Text {
+					t.Fatalf("hunk %s: old line %d is %q, not %q", h.Header(), next, old[next], l.Text)
+				}
+				next++
+			}
+			if l.Kind != DELETE {
+				result = append(result, l.Text)
+			}
+		}
+	}
+	return append(result, old[next:]...)
+}
+
+// Length of the longest common subsequence
+func lcs(a, b []string) int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(cur[j], prev[j+1])
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func randomLines(r *rand.Rand, n, alphabet int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = string(rune('a' + r.Intn(alphabet)))
+	}
+	return lines
+}
+
+func TestRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := range 2000 {
+		old := randomLines(r, r.Intn(30), 1+r.Intn(5))
+		new := randomLines(r, r.Intn(30), 1+r.Intn(5))
+		script := edits(old, new)
+		changes := 0
+		for _, l := range script {
+			if l.Kind != EQUAL {
+				changes++
+			}
+		}
+		if want := len(old) + len(new) - 2*lcs(old, new); changes != want {
+			t.Fatalf("%d: %v to %v takes %d changes, want %d", i, old, new, changes, want)
+		}
+		context := r.Intn(4)
+		if got := apply(t, old, Lines(old, new, context)); !slices.Equal(got, new) {
+			t.Fatalf("%d: hunks of context %d turn %v into %v, want %v", i, context, old, got, new)
+		}
+	}
+}
+
+func TestMaxEdits(t *testing.T) {
+	// Reversed lines need more than maxEdits edits, they are replaced at once
+	n := maxEdits + 2
+	old := make([]string, n)
+	for i := range old {
+		old[i] = fmt.Sprint(i)
+	}
+	new := slices.Clone(old)
+	slices.Reverse(new)
+	script := edits(old, new)
+	if len(script) != 2*n {
+		t.Errorf("%d lines in the script, want %d", len(script), 2*n)
+	}
+	hunks := group(script, 3)
+	if len(hunks) != 1 || hunks[0].Header() != fmt.Sprintf("@@ -1,%d +1,%d @@", n, n) {
+		t.Errorf("%d hunks, want one hunk of the whole texts", len(hunks))
+	}
+	if got := apply(t, old, hunks); !slices.Equal(got, new) {
+		t.Error("the hunks do not turn old into new")
+	}
+}
@@ -5,6 +5,10 @@ package editorview
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"slices"
+	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/gdamore/tcell/v2"
@@ -12,7 +16,6 @@ import (
 
 	"github.com/ge-editor/gecore"
 	"github.com/ge-editor/gecore/define"
-	"github.com/ge-editor/gecore/kill_buffer"
 	"github.com/ge-editor/gecore/lang"
 	"github.com/ge-editor/gecore/screen"
 	"github.com/ge-editor/gecore/tree"
@@ -41,6 +44,19 @@ var (
 	// BufferSets, _ = buffer.NewBufferSets(gecore.Files)
 	BufferSets *buffer.BufferSets
 	Marks      = mark.NewMarks()
+	Registers  = mark.NewRegisters()
+	JumpList   = mark.NewJumpList()
+
+	// Interval of writing crash-recovery files of dirty buffers, 0 disables it
+	AutosaveInterval = 30 * time.Second
+	lastAutosave     = time.Now()
+
+	// The region is active from setting the mark until a kill or copy, only the active region is highlighted
+	// If false the region is highlighted whenever the mark is set
+	TransientMarkMode = true
+
+	// Style of the region between the mark and the cursor, theme has none
+	ColorRegion = theme.ColorDefault.Background(tcell.ColorDarkSlateBlue)
 )
 
 func newEditor() *Editor {
@@ -100,13 +116,77 @@ func newFoundPosition(startRowIndex, startColIndex, stopRowIndex, stopColIndex i
 type foundPosition struct {
 	start file.Cursor
 	stop  file.Cursor
+
+	submatches []int // Submatch indexes from start of a regular expression search, see regexp.Regexp.Expand
+}
+
+// Case sensitivity of a search
+type CaseMode int
+
+const (
+	CaseSensitive CaseMode = iota
+	CaseInsensitive
+	SmartCase // Case sensitive only if the search text has an upper case letter
+)
+
+// Options of a search, see SearchText
+type SearchOptions struct {
+	Case      CaseMode
+	Regexp    bool // The search text is a regular expression, otherwise a literal text
+	WholeWord bool // Only matches not joined to a letter, digit or underscore on either side
+	InRegion  bool // Only matches between the mark and the cursor
+	Multiline bool // Search the whole buffer instead of each row, a match can span rows
 }
 
-// Returns the first index of the found search position that matches the row index.
+// Whether text is searched case sensitively
+func (o SearchOptions) caseSensitive(text string) bool {
+	switch o.Case {
+	case CaseInsensitive:
+		return false
+	case SmartCase:
+		return hasUpper(text, o.Regexp)
+	}
+	return true
+}
+
+// Compile the search text, a literal text is quoted
+// ^ and $ of a regular expression match at the start and end of each row
+func (o SearchOptions) compile(text string) (*regexp.Regexp, error) {
+	pattern := regexp.QuoteMeta(text)
+	if o.Regexp {
+		pattern = "(?m)" + text
+	}
+	if !o.caseSensitive(text) {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// Whether text has an upper case letter, escapes of a regular expression such as \S are not letters
+func hasUpper(text string, isRegexp bool) bool {
+	escaped := false
+	for _, r := range text {
+		if escaped {
+			escaped = false
+			continue
+		}
+		if isRegexp && r == '\\' {
+			escaped = true
+			continue
+		}
+		if unicode.IsUpper(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first index of the found search position that ends in or after the row index.
+// A position spanning rows from above the row is included.
 // Return -1, not found match position.
 func (e *Editor) getFoundPosition(rowIndex int) int {
 	for i := 0; i < len(e.foundIndexes); i++ {
-		if e.foundIndexes[i].start.RowIndex >= rowIndex {
+		if stop := e.foundIndexes[i].stop; stop.RowIndex > rowIndex || (stop.RowIndex == rowIndex && stop.ColIndex > 0) {
 			return i
 		}
 	}
@@ -156,6 +236,16 @@ type Editor struct {
 	currentSearchIndex int
 	foundIndexes       []foundPosition
 
+	region region // Region highlighted by drawLine, updated by drawView
+
+	isearch      *isearchState      // Incremental search in progress
+	queryReplace *queryReplaceState // Query replace in progress
+
+	foundRegexp *regexp.Regexp // Regular expression of foundIndexes, nil for a text search
+
+	lastYank *yankState // Text inserted by the last yank, replaced by YankPop
+	lastKill *killState // State after the last KillLine, the next one appends to its kill
+
 	miniBufferMode int
 }
 
@@ -188,6 +278,8 @@ func (e *Editor) Draw() {
 	verb.PP("editorview.Draw %d", d)
 	d++
 
+	flushGrep()
+	flushReplaceInFiles()
 	e.drawView()
 	e.drawRightBar()
 }
@@ -212,6 +304,7 @@ func (e *Editor) Kill(leaf *tree.Leaf, isActive bool) *tree.Leaf {
 
 	leafEditor := (*leaf).(*Editor)
 	if isActive {
+		leafEditor.SaveUndo()
 		bufferSetsIndex = BufferSets.RemoveByBufferFile(leafEditor.File) // 該当するバッファを取り除く
 	}
 	l := len(*BufferSets)
@@ -239,21 +332,36 @@ func (e *Editor) Kill(leaf *tree.Leaf, isActive bool) *tree.Leaf {
 
 func (e *Editor) ViewActive(a bool) {
 	e.active = a
+	if a && !e.CheckModifiedOnDisk() {
+		e.CheckRecovery()
+	}
 }
 
 // If event requires special handling
 // For EventResize, use the Resize method of interface
 func (e *Editor) Event(tev *tcell.Event) *tcell.Event {
+	if e.queryReplace != nil && e.queryReplace.file != e.File {
+		e.finishQueryReplace()
+	}
+	autosave()
+	pullClipboard(e.screen)
+	flushClipboard()
+	flushGrep()
+	flushReplaceInFiles()
 	return tev
 }
 
 func (e *Editor) Resume() {
+	e.CheckModifiedOnDisk()
 }
 
 func (e *Editor) Init() {
 }
 
 func (e *Editor) WillClose() {
+	if err := BufferSets.SaveUndo(); err != nil {
+		verb.PP("save undo %s", err.Error())
+	}
 }
 
 func (e *Editor) MiniBufferMode(mode int) {
@@ -314,10 +422,26 @@ func (e *Editor) syncCursorAndBufferForEdit(sync syncType, start, end file.Curso
 			case DELETE:
 				meta.Cursor.AdjustForDeletion(start, end)
 			}
+			adjustCursors(meta.Cursors, sync, start, end)
 		}
 		break
 	}
 
+	// Secondary cursors of this editor, the cursor is adjusted by the caller
+	adjustCursors(e.Cursors, sync, start, end)
+
+	// Marks, registers and jump list entries of the file keep pointing at the same text
+	adjust := markAdjuster(e.GetPath(), sync, start, end)
+	for _, m := range *Marks {
+		adjust(m)
+	}
+	for _, m := range Registers {
+		adjust(m)
+	}
+	for _, m := range JumpList.Marks() {
+		adjust(m)
+	}
+
 	// Synchronize cursor positions and buffer boundaries in other editors linked to the same file.
 	leaves := tree.GetLeavesByViewName("editorview")
 	for _, leaf := range leaves {
@@ -342,6 +466,7 @@ func (e *Editor) syncCursorAndBufferForEdit(sync syncType, start, end file.Curso
 		if editor == e {
 			continue
 		}
+		adjustCursors(editor.Cursors, sync, start, end)
 
 		switch sync {
 		case INSERT:
@@ -360,6 +485,39 @@ func (e *Editor) syncCursorAndBufferForEdit(sync syncType, start, end file.Curso
 	}
 }
 
+// Return the function adjusting a mark in the file of path for the edit
+// Paths are compared as mark.FilterByPath does, once for each path of the marks
+func markAdjuster(path string, sync syncType, start, end file.Cursor) func(m *mark.Mark) {
+	same := map[string]bool{}
+	return func(m *mark.Mark) {
+		isSame, ok := same[m.FilePath]
+		if !ok {
+			isSame = m.FilePath == path || utils.SameFile(m.FilePath, path) // Unsaved and scratch files are not on disk
+			same[m.FilePath] = isSame
+		}
+		if !isSame {
+			return
+		}
+		switch sync {
+		case INSERT:
+			m.Cursor.AdjustForInsertion(start, end)
+		case DELETE:
+			m.Cursor.AdjustForDeletion(start, end)
+		}
+	}
+}
+
+func adjustCursors(cursors []file.Cursor, sync syncType, start, end file.Cursor) {
+	for i := range cursors {
+		switch sync {
+		case INSERT:
+			cursors[i].AdjustForInsertion(start, end)
+		case DELETE:
+			cursors[i].AdjustForDeletion(start, end)
+		}
+	}
+}
+
 // ------------------------------------------------------------------
 //
 // ------------------------------------------------------------------
@@ -388,7 +546,7 @@ func (e *Editor) runeToDisplayStringForModeline(ch rune) string {
 	} else if ch == '\t' {
 		str = `\t`
 	} else if ch == define.LF {
-		linefeed := e.GetLinefeed()
+		linefeed := e.GetRowLinefeed(e.RowIndex)
 		if linefeed == "LF" {
 			str = `\n`
 		} else if linefeed == "CRLF" {
@@ -427,6 +585,10 @@ func (e *Editor) drawModeline() {
 	str := e.runeToDisplayStringForModeline(ch)
 	s += fmt.Sprintf(" ('%s', %d, 0x%02X)", str, ch, ch)
 
+	if e.isearch != nil {
+		s += " " + e.isearchModeline()
+	}
+
 	a := theme.ColorModelineInactive
 	if e.active {
 		a = theme.ColorModeLineActive
@@ -491,14 +653,14 @@ func (e *Editor) copyRegion(a, b file.Cursor) error {
 	if s == nil {
 		return nil
 	}
-	err := kill_buffer.KillBuffer.PushKillBuffer([]byte(string(*s)))
-	return err
+	return pushKillBuffer([]byte(string(*s)))
 }
 
 var events []lang.Event
 
 // Draw the screen based on Editor.currentRowIndex, logical row position logicalCY, and cursor position Editor.Cy
 func (e *Editor) drawView() {
+	e.region = e.activeRegion()
 
 	// Tree-sitter test implementation
 	ctx, cancel := context.WithCancel(context.Background())
@@ -507,7 +669,7 @@ func (e *Editor) drawView() {
 
 	var err error
 	if events == nil {
-		p, _, _ := utils.JoinBytes(*e.Rows())
+		p, _, _ := e.Bytes()
 		events, tree, err = (*e.GetLangMode()).ColorizeEvents(ctx, tree, p)
 		if err != nil {
 			verb.PP("Error: %v", err)
@@ -609,7 +771,7 @@ func (e *Editor) drawView() {
 
 	// Tree-sitter
 	// 描画開始行以降の eventIndex を取得する
-	eventIndex, currentStyle, err := (*e.GetLangMode()).EventIndex(ctx, e.StartDrawRowIndex, 0, *e.Rows(), events, 0)
+	eventIndex, currentStyle, err := (*e.GetLangMode()).EventIndex(ctx, e.StartDrawRowIndex, 0, e.BytesArray(), events, 0)
 	if err != nil {
 		verb.PP("EventIndex error: %s", err)
 	}
@@ -620,6 +782,10 @@ func (e *Editor) drawView() {
 	} */
 	// Set to 0 to find search results from the beginning
 	// e.nextDrawFoundIndex =0
+	if e.isearch != nil {
+		// At most height rows are visible
+		e.highlightISearch(e.StartDrawRowIndex, e.StartDrawRowIndex+height)
+	}
 	foundPositionIndex = e.getFoundPosition(e.StartDrawRowIndex)
 	// verb.PP("*foundPositionIndex %d", foundPositionIndex)
 	var i int
@@ -648,6 +814,32 @@ func (e *Editor) drawView() {
 	// e.screen.Echo(fmt.Sprintf("line: %d:%d-%d", e.StartDrawRowIndex, e.StartDrawLogicalIndex, e.EndDrawRowIndex))
 }
 
+// Region between the mark and the cursor
+type region struct {
+	start, stop file.Cursor
+	active      bool
+}
+
+// Region to highlight, inactive if the mark is not set
+// In transient mark mode the region is active from SetMark until a kill or copy
+func (e *Editor) activeRegion() region {
+	if TransientMarkMode && !e.MarkActive {
+		return region{}
+	}
+	m := Marks.FindLastByPath(e.GetPath())
+	if m == nil || m.Equals(e.Cursor) {
+		return region{}
+	}
+	if isCursorInRange(m.RowIndex, m.ColIndex, e.RowIndex, e.ColIndex, e.RowIndex, e.ColIndex) < 0 {
+		return region{start: m.Cursor, stop: e.Cursor, active: true}
+	}
+	return region{start: e.Cursor, stop: m.Cursor, active: true}
+}
+
+func (r region) contains(rowIndex, colIndex int) bool {
+	return r.active && isCursorInRange(rowIndex, colIndex, r.start.RowIndex, r.start.ColIndex, r.stop.RowIndex, r.stop.ColIndex) == 0
+}
+
 func is(class screen.CharClass, flag screen.CharClass) bool {
 	return class&flag != 0
 }
@@ -749,7 +941,14 @@ func (e *Editor) drawLine(n, rowIndex, cursorLogicalCY int, draw bool, foundPosi
 	//defer cancel()
 	var err error
 
+	// Style before the region or a secondary cursor was drawn, restored for the next character
+	overlaid, styleBeforeOverlay := false, style
+
 	for i := 0; i < lineLength; {
+		if overlaid {
+			style = styleBeforeOverlay
+			overlaid = false
+		}
 		// eventIndex, style, err = (*e.LangMode).EventIndex(ctx, rowIndex, i, *e.Rows(), events, eventIndex)
 		ss := style
 		// eventIndex, style, err = (*e.LangMode).EventIndex(ctx, rowIndex, i, *e.Rows(), events, 0)
@@ -765,7 +964,7 @@ func (e *Editor) drawLine(n, rowIndex, cursorLogicalCY int, draw bool, foundPosi
 		// ch, c.size, ok = lines.DecodeRune(rowIndex, i)
 		ch, c.size, ok = (*lines).Row(rowIndex).DecodeRune(i)
 		if !ok {
-			panic(fmt.Sprintf("%d '%s'", rowIndex, string((*lines)[rowIndex])))
+			panic(fmt.Sprintf("%d '%s'", rowIndex, string(lines.Row(rowIndex).Bytes())))
 		}
 		c.width = utils.RuneWidth(ch)
 		c.class = screen.GetCharClass(ch)
@@ -815,6 +1014,17 @@ func (e *Editor) drawLine(n, rowIndex, cursorLogicalCY int, draw bool, foundPosi
 				*foundPositionIndex++
 			}
 		}
+		if draw && e.region.contains(rowIndex, i) {
+			overlaid, styleBeforeOverlay = true, style
+			_, bg, _ := ColorRegion.Decompose()
+			style = style.Background(bg)
+		}
+		if len(e.Cursors) > 0 && slices.Contains(e.Cursors, file.Cursor{RowIndex: rowIndex, ColIndex: i}) {
+			if !overlaid {
+				overlaid, styleBeforeOverlay = true, style
+			}
+			style = style.Reverse(true)
+		}
 		style = style.Underline(isUnderline())
 
 		if x+c.width >= e.editArea.Width-8 && isBreakpoint(p2, p1, c) {
@@ -947,7 +1157,7 @@ func (e *Editor) runeWidth(ch rune, rowIndex, colIndex int) (w int, ok bool) {
 }
 
 func (e *Editor) isEndOfLogicalRow(rowIndex, colIndex int) bool {
-	_, size := utf8.DecodeRune((*e.Rows())[rowIndex][colIndex:])
+	_, size := utf8.DecodeRune(e.Rows().Row(rowIndex).Bytes()[colIndex:])
 	for i := 0; i < e.bsArray.BoundariesLen(rowIndex); i++ {
 		if colIndex+size == e.bsArray.Boundary(rowIndex, i).StopIndex {
 			return true
@@ -0,0 +1,194 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BackupStyle int
+
+const (
+	BACKUP_NONE        BackupStyle = iota // No backup
+	BACKUP_SINGLE                         // path~, overwritten on every backup
+	BACKUP_NUMBERED                       // path.~N~
+	BACKUP_TIMESTAMPED                    // path.~20060102-150405~
+)
+
+const backupTimeFormat = "20060102-150405"
+
+// BackupPolicy decides how File.Backup copies the file on disk before it is saved
+type BackupPolicy struct {
+	Style BackupStyle
+
+	// Central directory of backups, backups are named after the mangled absolute path of the file
+	// Backups are created next to the file if empty
+	Dir string
+
+	// Number of numbered or timestamped backups kept for each file, older ones are removed
+	// Unlimited if 0
+	MaxVersions int
+
+	// Backup only on the first save of the file in this session
+	FirstSaveOnly bool
+}
+
+var (
+	backupPolicy = BackupPolicy{Style: BACKUP_NUMBERED}
+	backupMutex  sync.RWMutex
+)
+
+// SetBackupPolicy sets the backup policy of all files
+func SetBackupPolicy(policy BackupPolicy) {
+	backupMutex.Lock()
+	defer backupMutex.Unlock()
+	backupPolicy = policy
+}
+
+func GetBackupPolicy() BackupPolicy {
+	backupMutex.RLock()
+	defer backupMutex.RUnlock()
+	return backupPolicy
+}
+
+// Backup copies the file on disk by the backup policy
+// Nothing is done if the file does not exist yet
+func (ff *File) Backup() error {
+	policy := GetBackupPolicy()
+	if policy.Style == BACKUP_NONE || (policy.FirstSaveOnly && ff.backedUp) {
+		return nil
+	}
+	if info, err := os.Stat(ff.path); err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+
+	dir, base := filepath.Split(ff.path)
+	if policy.Dir != "" {
+		if err := os.MkdirAll(policy.Dir, 0700); err != nil {
+			return err
+		}
+		dir, base = policy.Dir, manglePath(ff.path)
+	}
+	prefix := filepath.Join(dir, base)
+
+	var err error
+	switch policy.Style {
+	case BACKUP_SINGLE:
+		err = copyFile(ff.path, prefix+"~")
+	case BACKUP_NUMBERED:
+		versions, listErr := backupVersions(dir, base)
+		if listErr != nil {
+			return listErr
+		}
+		next := 1
+		for _, version := range versions {
+			if n, err := strconv.Atoi(version); err == nil && n >= next {
+				next = n + 1
+			}
+		}
+		err = copyFile(ff.path, fmt.Sprintf("%s.~%d~", prefix, next))
+	case BACKUP_TIMESTAMPED:
+		// A backup of the same second is kept as it is
+		backup := fmt.Sprintf("%s.~%s~", prefix, time.Now().Format(backupTimeFormat))
+		if _, statErr := os.Stat(backup); statErr != nil {
+			err = copyFile(ff.path, backup)
+		}
+	default:
+		return fmt.Errorf("unknown backup style %d", policy.Style)
+	}
+	if err != nil {
+		return err
+	}
+	ff.backedUp = true
+
+	if policy.MaxVersions > 0 && policy.Style != BACKUP_SINGLE {
+		return pruneBackups(dir, base, policy.MaxVersions)
+	}
+	return nil
+}
+
+// Return the versions of numbered or timestamped backups of base in dir, oldest first
+func backupVersions(dir, base string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := base + ".~"
+	versions := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, "~") || len(name) <= len(prefix)+1 {
+			continue
+		}
+		version := name[len(prefix) : len(name)-1]
+		if _, err := strconv.Atoi(version); err == nil {
+			versions = append(versions, version)
+		} else if _, err := time.Parse(backupTimeFormat, version); err == nil {
+			versions = append(versions, version)
+		}
+	}
+	// Numbers by value, timestamps after numbers in time order
+	slices.SortFunc(versions, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+		return strings.Compare(a, b)
+	})
+	return versions, nil
+}
+
+// Remove the oldest backups of base in dir leaving max versions
+func pruneBackups(dir, base string, max int) (errs error) {
+	versions, err := backupVersions(dir, base)
+	if err != nil {
+		return err
+	}
+	for len(versions) > max {
+		backup := filepath.Join(dir, fmt.Sprintf("%s.~%s~", base, versions[0]))
+		if err := os.Remove(backup); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = errors.Join(errs, err)
+		}
+		versions = versions[1:]
+	}
+	return errs
+}
+
+// Escapes a path into a file name, ":" is not allowed in Windows file names
+// "!" only stands for "/" and "%" only starts an escape, so different paths never share a name
+var pathMangler = strings.NewReplacer("%", "%25", "!", "%21", ":", "%3A", "/", "!")
+
+// Mangle an absolute path to a file name, "/home/a!b/c:d.go" is "!home!a%21b!c%3Ad.go"
+func manglePath(path string) string {
+	return pathMangler.Replace(filepath.ToSlash(path))
+}
+
+// Copy src to dst with the permission of src
+func copyFile(src, dst string) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	info, err := s.Stat()
+	if err != nil {
+		return err
+	}
+	d, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(d, s); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
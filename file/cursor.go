@@ -1,5 +1,7 @@
 package file
 
+import "cmp"
+
 type Cursor struct {
 	RowIndex int
 	ColIndex int
@@ -9,22 +11,18 @@ func (c Cursor) Equals(other Cursor) bool {
 	return c.RowIndex == other.RowIndex && c.ColIndex == other.ColIndex
 }
 
-// adjustCursorForDeletion updates the cursor position to reflect the deleted text within the buffer.
-func (c *Cursor) AdjustForDeletion(deleteStart, deleteEnd Cursor) {
-	// If the cursor is before the deletion row, no adjustment is needed.
-	if c.RowIndex < deleteStart.RowIndex {
-		return
+// Compare returns -1 if c is before other, 1 if after and 0 if they are equal
+func (c Cursor) Compare(other Cursor) int {
+	if c.RowIndex != other.RowIndex {
+		return cmp.Compare(c.RowIndex, other.RowIndex)
 	}
+	return cmp.Compare(c.ColIndex, other.ColIndex)
+}
 
-	// If the cursor is on the same row as the deletion start:
-	if c.RowIndex == deleteStart.RowIndex {
-		// If the deletion is after the cursor column, leave the cursor unchanged.
-		// if cursor.ColIndex < deleteStart.ColIndex {
-		if c.ColIndex <= deleteStart.ColIndex {
-			return
-		}
-		// If the deletion affects the cursor's position within the same row, move it to the start of deletion.
-		c.ColIndex = deleteStart.ColIndex
+// adjustCursorForDeletion updates the cursor position to reflect the deleted text within the buffer.
+func (c *Cursor) AdjustForDeletion(deleteStart, deleteEnd Cursor) {
+	// If the cursor is before the deletion start, no adjustment is needed.
+	if c.RowIndex < deleteStart.RowIndex || (c.RowIndex == deleteStart.RowIndex && c.ColIndex <= deleteStart.ColIndex) {
 		return
 	}
 
@@ -35,6 +33,13 @@ func (c *Cursor) AdjustForDeletion(deleteStart, deleteEnd Cursor) {
 		return
 	}
 
+	// If the cursor is on the deletion end row after the deletion, the rest of the row joins the deletion start.
+	if c.RowIndex == deleteEnd.RowIndex && c.ColIndex >= deleteEnd.ColIndex {
+		c.ColIndex = c.ColIndex - deleteEnd.ColIndex + deleteStart.ColIndex
+		c.RowIndex = deleteStart.RowIndex
+		return
+	}
+
 	// If the cursor is within the deleted range, move it to the start of the deletion.
 	c.RowIndex = deleteStart.RowIndex
 	c.ColIndex = deleteStart.ColIndex
@@ -71,3 +76,23 @@ func (c *Cursor) AdjustForInsertion(insertStart, insertEnd Cursor) {
 	c.RowIndex += rowOffset
 	//return c
 }
+
+// EndCursor returns the cursor position after data is inserted at start.
+func EndCursor(start Cursor, data []byte) Cursor {
+	lines := SplitByLF(data)
+	if len(lines) == 0 {
+		return start
+	}
+	last := lines[len(lines)-1]
+	end := start
+	end.RowIndex += len(lines) - 1
+	if len(lines) > 1 {
+		end.ColIndex = 0
+	}
+	end.ColIndex += len(last)
+	if last[len(last)-1] == '\n' {
+		end.RowIndex++
+		end.ColIndex = 0
+	}
+	return end
+}
@@ -1,6 +1,12 @@
 package file
 
-import "github.com/ge-editor/utils"
+import (
+	"slices"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
 
 // Undoable interface
 type Undoable interface {
@@ -14,6 +20,9 @@ const (
 	INSERT ActionClass = iota
 	DELETE
 	DELETE_BACKWARD
+	LINEFEED // Change of File linefeed, From and To hold the default linefeed "LF", "CRLF" or "CR"
+	CHARSET  // Change of File encoding, From and To hold the charset names
+	CURSOR   // Cursor move only, to Before on undo and to After on redo
 )
 
 // Smallest unit of an edit operation
@@ -22,6 +31,41 @@ type EditAction struct {
 	Before Cursor
 	After  Cursor
 	Data   []byte
+	From   string    // Attribute value before the action, LINEFEED and CHARSET only
+	To     string    // Attribute value after the action, LINEFEED and CHARSET only
+	Time   time.Time // Time of the action, of the last merged one for merged actions
+
+	// Row terminators of a file with mixed linefeeds, nil otherwise
+	// Of the deleted linefeeds for DELETE and DELETE_BACKWARD, of all rows for LINEFEED
+	FromTerminators []byte
+	// Of the inserted linefeeds for INSERT, of all rows for LINEFEED
+	ToTerminators []byte
+}
+
+// CoalesceRules decide when PushAction stops merging typed or deleted characters into the last action
+type CoalesceRules struct {
+	Pause        time.Duration // Break after a pause longer than this, never if 0
+	WordBoundary bool          // Break where a word starts after spaces or punctuation
+	Newline      bool          // Break after a newline
+	MaxSize      int           // Break when the merged data would exceed this many bytes, unlimited if 0
+}
+
+var (
+	coalesceRules = CoalesceRules{Pause: time.Second, Newline: true}
+	coalesceMutex sync.RWMutex
+)
+
+// SetCoalesceRules sets the coalescing rules of all undo stacks
+func SetCoalesceRules(rules CoalesceRules) {
+	coalesceMutex.Lock()
+	defer coalesceMutex.Unlock()
+	coalesceRules = rules
+}
+
+func GetCoalesceRules() CoalesceRules {
+	coalesceMutex.RLock()
+	defer coalesceMutex.RUnlock()
+	return coalesceRules
 }
 
 func (e *EditAction) Undo() []*EditAction {
@@ -54,97 +98,339 @@ func (g *EditGroup) Redo() []*EditAction {
 // -------------------------
 // UndoStack
 // -------------------------
+
+// UndoStack is an undo tree, an edit after undo starts a new branch and keeps the redo branch
+// Redo follows the branch last visited
 type UndoStack struct {
-	stack    []Undoable
-	index    int
-	saveMark int
+	root    *undoNode // State when the file was loaded, holds no edit
+	current *undoNode // State of the buffer
+	saved   *undoNode // State of the file on disk, nil if unknown
+	seq     int       // Sequence number of the last node
+	changes int       // Number of changes of the state, see Changes
+
+	group      *EditGroup // Group collecting actions between BeginGroup and EndGroup
+	groupDepth int
+}
+
+type undoNode struct {
+	undoable Undoable
+	parent   *undoNode
+	children []*undoNode
+	active   int       // Index in children of the branch followed by Redo
+	seq      int       // Creation order
+	time     time.Time // Time of the edit
 }
 
 // Create a new UndoStack
 func NewUndoStack() *UndoStack {
+	root := &undoNode{time: time.Now()}
 	return &UndoStack{
-		stack:    make([]Undoable, 0),
-		index:    0,
-		saveMark: 0,
+		root:    root,
+		current: root,
+		saved:   root,
 	}
 }
 
 // Push a new action (merge with the last one if it's the same class and position)
 func (u *UndoStack) PushAction(a *EditAction) {
-	if u.index > 0 {
-		// If the previous action is the same class and cursor position,
-		// merge it into the last action instead of pushing a new one.
-		if prev, ok := u.stack[u.index-1].(*EditAction); ok {
-			if prev.Class == a.Class {
-				if a.Class == DELETE_BACKWARD && a.Before.Equals(prev.After) {
-					utils.ReverseUTF8Bytes(a.Data)
-					prev.Data = append(a.Data, prev.Data...)
-					prev.After = a.After
-					return
-				} else if a.Class == INSERT && prev.After.Equals(a.Before) {
-					prev.Data = append(prev.Data, a.Data...)
-					prev.After = a.After
-					return
-				} else if a.Class == DELETE && prev.After.Equals(a.Before) {
-					prev.Data = append(prev.Data, a.Data...)
-					prev.After = a.After
-					return
-				}
-			}
+	u.changes++
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+	if u.group != nil {
+		if n := len(u.group.Actions); n == 0 || !merge(u.group.Actions[n-1], a) {
+			u.group.Actions = append(u.group.Actions, a)
 		}
+		return
 	}
 
-	if u.index < len(u.stack) {
-		u.stack = u.stack[:u.index] // Clear redo buffer
+	// Never merge into the saved state, it must keep matching the file on disk,
+	// nor into a state other branches start from
+	if prev, ok := u.current.undoable.(*EditAction); ok && u.current != u.saved && len(u.current.children) == 0 {
+		if merge(prev, a) {
+			u.current.time = a.Time
+			return
+		}
 	}
-	u.stack = append(u.stack, a)
-	u.index++
+	u.push(a)
+}
+
+// If the previous action is the same class and cursor position,
+// merge it into the last action instead of pushing a new one.
+func merge(prev, a *EditAction) bool {
+	if prev.Class != a.Class {
+		return false
+	}
+	if a.Class == DELETE_BACKWARD && a.Before.Equals(prev.After) {
+		// Deleted backward, a.Data comes before prev.Data in the text
+		if coalesceBreaks(prev, a) {
+			return false
+		}
+		prev.Data = append(a.Data, prev.Data...)
+		prev.FromTerminators = concatTerminators(a.FromTerminators, prev.FromTerminators)
+	} else if (a.Class == INSERT || a.Class == DELETE) && prev.After.Equals(a.Before) {
+		if coalesceBreaks(prev, a) {
+			return false
+		}
+		prev.Data = append(prev.Data, a.Data...)
+		prev.FromTerminators = concatTerminators(prev.FromTerminators, a.FromTerminators)
+		prev.ToTerminators = concatTerminators(prev.ToTerminators, a.ToTerminators)
+	} else {
+		return false
+	}
+	prev.After = a.After
+	prev.Time = a.Time
+	return true
+}
+
+// Terminators of merged actions, nil if neither has any
+func concatTerminators(a, b []byte) []byte {
+	if a == nil && b == nil {
+		return nil
+	}
+	return slices.Concat(a, b)
+}
+
+// Check the coalescing rules before merging a into prev
+func coalesceBreaks(prev, a *EditAction) bool {
+	rules := GetCoalesceRules()
+	if rules.Pause > 0 && a.Time.Sub(prev.Time) > rules.Pause {
+		return true
+	}
+	if rules.MaxSize > 0 && len(prev.Data)+len(a.Data) > rules.MaxSize {
+		return true
+	}
+
+	// Runes on both sides of the join, in the order they were typed or deleted
+	older, _ := utf8.DecodeLastRune(prev.Data)
+	newer, _ := utf8.DecodeRune(a.Data)
+	if a.Class == DELETE_BACKWARD {
+		older, _ = utf8.DecodeRune(prev.Data)
+		newer, _ = utf8.DecodeLastRune(a.Data)
+	}
+	if rules.Newline && older == '\n' {
+		return true
+	}
+	if rules.WordBoundary && !isWordRune(older) && isWordRune(newer) {
+		return true
+	}
+	return false
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
 }
 
 // Push a group of actions (for macros, replace operations, etc.)
 func (u *UndoStack) PushGroup(g *EditGroup) {
-	if u.index < len(u.stack) {
-		u.stack = u.stack[:u.index] // Clear redo buffer
+	u.changes++
+	if u.group != nil {
+		u.group.Actions = append(u.group.Actions, g.Actions...)
+		return
 	}
-	u.stack = append(u.stack, g)
-	u.index++
+	u.push(g)
+}
+
+// Record returns the actions pushed while f runs, they are not pushed
+// A command spanning several events collects its actions with it, see ExtendGroup
+func (u *UndoStack) Record(f func()) []*EditAction {
+	group, depth := u.group, u.groupDepth
+	u.group, u.groupDepth = &EditGroup{}, 1
+	f()
+	actions := u.group.Actions
+	u.group, u.groupDepth = group, depth
+	return actions
+}
+
+// ExtendGroup appends actions to g if it is still the last state, it is undone with them
+// Otherwise, as after an undo, another edit or a save, a new group of cursor and actions is pushed
+// Returns the group to extend next time
+func (u *UndoStack) ExtendGroup(g *EditGroup, cursor Cursor, actions []*EditAction) *EditGroup {
+	if len(actions) == 0 {
+		return g
+	}
+	u.changes++
+	if u.group != nil {
+		u.group.Actions = append(u.group.Actions, actions...)
+		return g
+	}
+	if g != nil && u.current.undoable == g && u.current != u.saved && len(u.current.children) == 0 {
+		g.Actions = append(g.Actions, actions...)
+		u.current.time = time.Now()
+		return g
+	}
+	g = &EditGroup{Actions: append([]*EditAction{{Class: CURSOR, Before: cursor, After: cursor}}, actions...)}
+	u.push(g)
+	return g
+}
+
+// BeginGroup collects the following actions into one EditGroup until the matching EndGroup
+// Undo of the group moves the cursor back to cursor, where the command started
+// Groups nest, only the outermost one is pushed
+func (u *UndoStack) BeginGroup(cursor Cursor) {
+	u.groupDepth++
+	if u.groupDepth == 1 {
+		u.group = &EditGroup{Actions: []*EditAction{{Class: CURSOR, Before: cursor, After: cursor}}}
+	}
+}
+
+// EndGroup pushes the group started by BeginGroup
+// Nothing is pushed if there was no action,
+// a single action whose undo restores the cursor anyway is pushed as it is
+func (u *UndoStack) EndGroup() {
+	if u.groupDepth == 0 {
+		return
+	}
+	u.groupDepth--
+	if u.groupDepth > 0 {
+		return
+	}
+	g := u.group
+	u.group = nil
+	if len(g.Actions) == 1 {
+		return // Only the cursor
+	}
+	if a := g.Actions[1]; len(g.Actions) == 2 && (a.Class == INSERT || a.Class == DELETE) && a.Before.Equals(g.Actions[0].Before) {
+		u.PushAction(a)
+		return
+	}
+	u.push(g)
+}
+
+// Add a new branch from the current state
+func (u *UndoStack) push(undoable Undoable) {
+	u.seq++
+	node := &undoNode{undoable: undoable, parent: u.current, seq: u.seq, time: time.Now()}
+	u.current.children = append(u.current.children, node)
+	u.current.active = len(u.current.children) - 1
+	u.current = node
 }
 
 // Undo the last action/group
 func (u *UndoStack) Undo() []*EditAction {
-	if u.index == 0 {
+	if u.current == u.root {
 		return nil
 	}
-	u.index--
-	return u.stack[u.index].Undo()
+	u.changes++
+	node := u.current
+	u.current = node.parent
+	return node.undoable.Undo()
 }
 
 // Redo the next action/group
 func (u *UndoStack) Redo() []*EditAction {
-	if u.index >= len(u.stack) {
+	if len(u.current.children) == 0 {
 		return nil
 	}
-	res := u.stack[u.index].Redo()
-	u.index++
-	return res
+	u.changes++
+	u.current = u.current.children[u.current.active]
+	return u.current.undoable.Redo()
+}
+
+// Changes counts the edits, undos and redos so far
+// Commands compare it to tell whether the buffer changed since they last ran
+func (u *UndoStack) Changes() int {
+	return u.changes
 }
 
 // Check if undo stack is empty
 func (u *UndoStack) IsUndoEmpty() bool {
-	return u.index == 0
+	return u.current == u.root
 }
 
 // Check if redo stack is empty
 func (u *UndoStack) IsRedoEmpty() bool {
-	return u.index >= len(u.stack)
+	return len(u.current.children) == 0
 }
 
 // Mark the current position as "saved"
 func (u *UndoStack) MarkSaved() {
-	u.saveMark = u.index
+	u.saved = u.current
+}
+
+// Mark that no position matches the file on disk, the buffer stays dirty until saved
+func (u *UndoStack) MarkUnsaved() {
+	u.saved = nil
 }
 
 // Check if the buffer is dirty (modified after last save)
 func (u *UndoStack) IsDirty() bool {
-	return u.index != u.saveMark
+	return u.current != u.saved
+}
+
+// Branch returns the 1-based index of the current state among its siblings and the number of siblings
+func (u *UndoStack) Branch() (index, count int) {
+	if u.current == u.root {
+		return 1, 1
+	}
+	siblings := u.current.parent.children
+	return slices.Index(siblings, u.current) + 1, len(siblings)
+}
+
+// SwitchBranch moves to the sibling branch delta away from the current state, wrapping around
+// Returns the actions to undo, then to redo, in order
+func (u *UndoStack) SwitchBranch(delta int) (undo, redo [][]*EditAction) {
+	if u.current == u.root || len(u.current.parent.children) < 2 {
+		return nil, nil
+	}
+	siblings := u.current.parent.children
+	n := len(siblings)
+	i := ((slices.Index(siblings, u.current)+delta)%n + n) % n
+	return u.moveTo(siblings[i])
+}
+
+// Time returns the time of the edit of the current state
+func (u *UndoStack) Time() time.Time {
+	return u.current.time
+}
+
+// MoveToTime moves to the latest state edited at or before t, on any branch
+// Before the first edit it is the state when the file was loaded
+// Returns the actions to undo, then to redo, in order
+func (u *UndoStack) MoveToTime(t time.Time) (undo, redo [][]*EditAction) {
+	target := u.root
+	u.walk(func(node *undoNode) {
+		if node == u.root || node.time.After(t) {
+			return
+		}
+		if target == u.root || node.time.After(target.time) || (node.time.Equal(target.time) && node.seq > target.seq) {
+			target = node
+		}
+	})
+	return u.moveTo(target)
+}
+
+// Visit all nodes of the tree
+func (u *UndoStack) walk(visit func(node *undoNode)) {
+	stack := []*undoNode{u.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		visit(node)
+		for i := len(node.children) - 1; i >= 0; i-- {
+			stack = append(stack, node.children[i]) // Visit children in order
+		}
+	}
+}
+
+// Move the current state to target through their common ancestor,
+// Redo follows the path to target afterwards
+func (u *UndoStack) moveTo(target *undoNode) (undo, redo [][]*EditAction) {
+	ancestors := map[*undoNode]bool{}
+	for node := target; node != nil; node = node.parent {
+		ancestors[node] = true
+	}
+	for !ancestors[u.current] {
+		undo = append(undo, u.Undo())
+	}
+
+	path := []*undoNode{}
+	for node := target; node != u.current; node = node.parent {
+		path = append(path, node)
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		u.current.active = slices.Index(u.current.children, path[i])
+		redo = append(redo, u.Redo())
+	}
+	return undo, redo
 }
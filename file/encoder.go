@@ -1,14 +1,225 @@
 package file
 
+import (
+	"bytes"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/ge-editor/editorview/pkg_error"
+)
+
+const defaultCharset = "UTF-8"
+
+// Encoder converts a file between its charset and UTF-8
 type Encoder interface {
-	Encoder(string, *[]byte) error // Save file
-	GuessCharset(path string, bytes int) (string, error)
-	Decoder(*[]byte) (string, error) // Load file
-	IsDecodedMessage(error) bool
+	Charset() string                 // Charset name shown on the modeline
+	Detect(data []byte) bool         // Report whether data is written in this charset
+	Decoder(*[]byte) error           // Load file, convert to UTF-8. Return a message such as pkg_error.ErrShiftJis on success
+	Encoder(*[]byte) error           // Save file, convert from UTF-8
+	IsDecodedMessage(err error) bool // Report whether err returned by Decoder is a message, not a failure
+}
+
+// Registered encoders, tried in order when a file is loaded
+var encoders = []Encoder{
+	&utf16Encoder{charset: "UTF-16LE", bom: []byte{0xFF, 0xFE}, endianness: unicode.LittleEndian},
+	&utf16Encoder{charset: "UTF-16BE", bom: []byte{0xFE, 0xFF}, endianness: unicode.BigEndian},
+	&utf8MacEncoder{},
+	&textEncoder{charset: "EUC-JP", encoding: japanese.EUCJP, detect: isEUCJP, message: pkg_error.ErrEucJp},
+	&textEncoder{charset: "Shift_JIS", encoding: japanese.ShiftJIS, detect: isShiftJIS, message: pkg_error.ErrShiftJis},
+}
+
+// RegisterEncoder adds an Encoder.
+// Encoders registered later are tried first, so they can override the built-in ones.
+func RegisterEncoder(e Encoder) {
+	encoders = append([]Encoder{e}, encoders...)
+}
+
+// GetEncoder returns the Encoder for charset.
+// Return nil for UTF-8 or an unknown charset.
+func GetEncoder(charset string) Encoder {
+	for _, e := range encoders {
+		if e.Charset() == charset {
+			return e
+		}
+	}
+	return nil
+}
+
+// GetCharsets returns the charsets that can be used for a file
+func GetCharsets() []string {
+	charsets := []string{defaultCharset}
+	for _, e := range encoders {
+		charsets = append(charsets, e.Charset())
+	}
+	return charsets
+}
+
+// guessEncoder returns the first Encoder that detects data.
+// Return nil if data is UTF-8.
+func guessEncoder(data []byte) Encoder {
+	for _, e := range encoders {
+		if e.Detect(data) {
+			return e
+		}
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------
+// UTF-16 with BOM
+// ------------------------------------------------------------------
+
+type utf16Encoder struct {
+	charset    string
+	bom        []byte
+	endianness unicode.Endianness
+}
+
+func (u *utf16Encoder) Charset() string {
+	return u.charset
+}
+
+func (u *utf16Encoder) Detect(data []byte) bool {
+	return bytes.HasPrefix(data, u.bom)
+}
+
+func (u *utf16Encoder) Decoder(data *[]byte) error {
+	decoded, err := unicode.UTF16(u.endianness, unicode.ExpectBOM).NewDecoder().Bytes(*data)
+	if err != nil {
+		return err
+	}
+	*data = decoded
+	return pkg_error.ErrUtf16
+}
+
+func (u *utf16Encoder) Encoder(data *[]byte) (err error) {
+	*data, err = unicode.UTF16(u.endianness, unicode.UseBOM).NewEncoder().Bytes(*data)
+	return err
+}
+
+func (u *utf16Encoder) IsDecodedMessage(err error) bool {
+	return err == pkg_error.ErrUtf16
+}
+
+// ------------------------------------------------------------------
+// UTF-8-mac, NFD normalized UTF-8
+// ------------------------------------------------------------------
+
+type utf8MacEncoder struct{}
+
+func (u *utf8MacEncoder) Charset() string {
+	return "UTF-8-mac"
+}
+
+// Detected only if the whole content is NFD, a precomposed character in it is not rewritten on save
+func (u *utf8MacEncoder) Detect(data []byte) bool {
+	return utf8.Valid(data) && norm.NFD.IsNormal(data) && !norm.NFC.IsNormal(data)
+}
+
+func (u *utf8MacEncoder) Decoder(data *[]byte) error {
+	*data = norm.NFC.Bytes(*data)
+	return pkg_error.ErrMac
+}
+
+func (u *utf8MacEncoder) Encoder(data *[]byte) error {
+	*data = norm.NFD.Bytes(*data)
+	return nil
+}
+
+func (u *utf8MacEncoder) IsDecodedMessage(err error) bool {
+	return err == pkg_error.ErrMac
+}
+
+// ------------------------------------------------------------------
+// Multibyte charsets of golang.org/x/text
+// ------------------------------------------------------------------
+
+type textEncoder struct {
+	charset  string
+	encoding encoding.Encoding
+	detect   func([]byte) bool
+	message  error
+}
+
+func (t *textEncoder) Charset() string {
+	return t.charset
+}
+
+func (t *textEncoder) Detect(data []byte) bool {
+	return !utf8.Valid(data) && t.detect(data)
+}
+
+func (t *textEncoder) Decoder(data *[]byte) error {
+	decoded, err := t.encoding.NewDecoder().Bytes(*data)
+	if err != nil {
+		return err
+	}
+	*data = decoded
+	return t.message
+}
+
+// Return an error if the text contains a character that the charset can't represent
+func (t *textEncoder) Encoder(data *[]byte) (err error) {
+	*data, err = t.encoding.NewEncoder().Bytes(*data)
+	return err
+}
+
+func (t *textEncoder) IsDecodedMessage(err error) bool {
+	return err == t.message
+}
+
+// isEUCJP reports whether every non-ASCII byte sequence of data is valid EUC-JP
+func isEUCJP(data []byte) bool {
+	isTrail := func(b byte) bool { return b >= 0xA1 && b <= 0xFE }
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		switch {
+		case b < 0x80:
+		case b == 0x8E: // SS2, half-width katakana
+			if i+1 >= len(data) || data[i+1] < 0xA1 || data[i+1] > 0xDF {
+				return false
+			}
+			i++
+		case b == 0x8F: // SS3, JIS X 0212
+			if i+2 >= len(data) || !isTrail(data[i+1]) || !isTrail(data[i+2]) {
+				return false
+			}
+			i += 2
+		case isTrail(b):
+			if i+1 >= len(data) || !isTrail(data[i+1]) {
+				return false
+			}
+			i++
+		default:
+			return false
+		}
+	}
+	return true
 }
 
-/*
-func SetEncoder(e *Encoder) {
-	encorder = e
+// isShiftJIS reports whether every non-ASCII byte sequence of data is valid Shift_JIS
+func isShiftJIS(data []byte) bool {
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		switch {
+		case b < 0x80:
+		case b >= 0xA1 && b <= 0xDF: // half-width katakana
+		case (b >= 0x81 && b <= 0x9F) || (b >= 0xE0 && b <= 0xFC):
+			if i+1 >= len(data) {
+				return false
+			}
+			t := data[i+1]
+			if t < 0x40 || t == 0x7F || t > 0xFC {
+				return false
+			}
+			i++
+		default:
+			return false
+		}
+	}
+	return true
 }
-*/
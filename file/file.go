@@ -3,6 +3,7 @@ package file
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/ge-editor/gecore"
@@ -26,12 +28,36 @@ type linefeed int8
 
 const (
 	READONLY flags = 1 << iota
+	SCRATCH        // Not backed by a file on disk, such as a diff or search results
 
 	LF linefeed = 1 << iota
 	CRLF
 	CR
 )
 
+// Returned by File.GetLinefeed if rows have different linefeeds
+const MixedLinefeed = "Mixed"
+
+func (lf linefeed) String() string {
+	if lf&CRLF > 0 {
+		return "CRLF"
+	}
+	if lf&CR > 0 {
+		return "CR"
+	}
+	return "LF"
+}
+
+func (lf linefeed) bytes() []byte {
+	if lf&CRLF > 0 {
+		return []byte{'\r', '\n'}
+	}
+	if lf&CR > 0 {
+		return []byte{'\r'}
+	}
+	return []byte{'\n'}
+}
+
 type File struct {
 	rawPath  string
 	path     string
@@ -42,14 +68,25 @@ type File struct {
 	size    int64
 	mode    os.FileMode
 	modTime time.Time
+	onDisk  bool              // The file existed when size, mode and modTime were recorded
+	diskSum [sha256.Size]byte // Hash of the file content on disk after Load or Save, keys the undo store
+
+	backedUp bool // Backup was made in this session
+
+	recoveryWritten bool             // The crash-recovery file was written in this session
+	recoveryRows    *rows.RowsStruct // Rows and their version last written to the crash-recovery file
+	recoveryVersion uint64
+	recoverySeq     atomic.Uint64 // Counts the writes and removals of the crash-recovery file, a superseded one is skipped
 
 	langMode *lang.Mode
 
 	*rows.RowsStruct
-	encoding string
-	linefeed
+	encoding       string
+	decodedMessage error // Message of the Encoder that decoded the file on Load
+	linefeed             // Linefeed of rows without their own terminator, and of new rows
+	mixedLinefeed  bool  // Rows keep their own terminator, see GetRowLinefeeds
 
-	flags // readonly
+	flags // readonly, scratch
 
 	// UndoAction *ActionGroup
 	// RedoAction *ActionGroup
@@ -74,7 +111,7 @@ func NewFile(rawPath string) *File {
 		langMode: langMode,
 
 		RowsStruct: nil,
-		encoding:   "UTF-8",
+		encoding:   defaultCharset,
 		linefeed:   LF,
 
 		flags: 0,
@@ -93,18 +130,11 @@ func (ff *File) init() {
 		ff.rawPath = "unnamed"
 	}
 
-	ff.size = 0
-	ff.mode = fs.ModePerm
-	ff.modTime = time.Now()
-	info, err := os.Stat(ff.rawPath)
-	if err == nil {
-		if info.IsDir() {
-			ff.rawPath = "unnamed"
-		}
-		ff.size = info.Size()
-		ff.mode = info.Mode()
-		ff.modTime = info.ModTime()
+	if info, err := os.Stat(ff.rawPath); err == nil && info.IsDir() {
+		ff.rawPath = "unnamed"
 	}
+	ff.stat(ff.rawPath)
+	var err error
 	ff.path, err = filepath.Abs(ff.rawPath)
 	if err != nil {
 		ff.path = ""
@@ -124,8 +154,43 @@ func (ff *File) init() {
 	ff.ext = filepath.Ext(ff.path)
 }
 
+// Record size, mode and modification time of the file on disk
+func (ff *File) stat(path string) {
+	ff.size = 0
+	ff.mode = fs.ModePerm
+	ff.modTime = time.Now()
+	ff.onDisk = false
+	info, err := os.Stat(path)
+	if err == nil && !info.IsDir() {
+		ff.size = info.Size()
+		ff.mode = info.Mode()
+		ff.modTime = info.ModTime()
+		ff.onDisk = true
+	}
+}
+
+// IsModifiedOnDisk reports whether the file on disk changed since it was loaded or saved
+// A removed file is not reported, saving creates it again
+func (ff *File) IsModifiedOnDisk() bool {
+	if ff.IsScratch() {
+		return false
+	}
+	info, err := os.Stat(ff.path)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	return !ff.onDisk || info.Size() != ff.size || !info.ModTime().Equal(ff.modTime)
+}
+
+// KeepModifiedOnDisk takes the current file on disk as the one the buffer was loaded from,
+// so that saving overwrites it
+func (ff *File) KeepModifiedOnDisk() {
+	ff.stat(ff.path)
+}
+
 func (ff *File) ChangePath(path string) {
 	ff.rawPath = path
+	ff.backedUp = false // The backup was of the old path
 	ff.init()
 }
 
@@ -164,7 +229,7 @@ func (ff *File) removeRegion(start, end Cursor, doRemove bool) *[]byte {
 	if start.RowIndex == end.RowIndex {
 		removed := topRow.SubBytes(start.ColIndex, end.ColIndex)
 		if doRemove {
-			*topRow = topRow.Delete(start.ColIndex, end.ColIndex)
+			ff.Rows().SetRow(start.RowIndex, topRow.Delete(start.ColIndex, end.ColIndex))
 		}
 		return &removed
 	}
@@ -181,9 +246,6 @@ func (ff *File) removeRegion(start, end Cursor, doRemove bool) *[]byte {
 
 	// top row
 	removed = append(removed, (*topRow)[start.ColIndex:]...)
-	if doRemove {
-		*topRow = (*topRow)[:start.ColIndex]
-	}
 	// middle rows
 	for i := start.RowIndex + 1; i < end.RowIndex; i++ {
 		removed = append(removed, ff.Rows().Row(i).Bytes()...)
@@ -192,10 +254,13 @@ func (ff *File) removeRegion(start, end Cursor, doRemove bool) *[]byte {
 	removed = append(removed, (*bottomRow)[:end.ColIndex]...)
 	// Remove middle and bottom rows
 	if doRemove {
-		*topRow = append(*topRow, (*bottomRow)[end.ColIndex:]...)
+		ff.Rows().SetRow(start.RowIndex, append((*topRow)[:start.ColIndex], (*bottomRow)[end.ColIndex:]...))
+		// The joined row ends with the linefeed of the bottom row
+		terminator := ff.Rows().Terminator(end.RowIndex)
 		if end.RowIndex-start.RowIndex > 0 {
 			ff.Rows().Delete(start.RowIndex+1, end.RowIndex+1)
 		}
+		ff.Rows().SetTerminator(start.RowIndex, terminator)
 	}
 	return &removed
 }
@@ -242,6 +307,23 @@ func SplitByLF(s []byte) (results [][]byte) {
 	return
 }
 
+// SetContent replaces the rows with data of LF linefeeds, it is not recorded for undo
+// The linefeed of the file is kept, mixed linefeeds are normalized
+func (ff *File) SetContent(data []byte) {
+	loaded := SplitByLF(data)
+	for i := range loaded {
+		loaded[i] = slices.Clip(loaded[i]) // Rows must not share the backing array
+	}
+	if len(loaded) == 0 || loaded[len(loaded)-1][len(loaded[len(loaded)-1])-1] == '\n' {
+		loaded = append(loaded, []byte{define.EOF})
+	} else {
+		loaded[len(loaded)-1] = append(loaded[len(loaded)-1], define.EOF)
+	}
+	ff.RowsStruct = rows.New()
+	ff.SetRows(loaded)
+	ff.mixedLinefeed = false
+}
+
 // New file
 func (ff *File) New() error {
 	ff.RowsStruct = rows.New()
@@ -249,46 +331,114 @@ func (ff *File) New() error {
 
 	// Set linefeed type
 	ff.linefeed = LF
+	ff.mixedLinefeed = false
+	ff.encoding = defaultCharset
+	ff.decodedMessage = nil
 	// m.rows.Dump()
 	return nil
 }
 
 // Load file
+// The charset is guessed by the registered encoders and the content is decoded to UTF-8
 func (ff *File) Load() error {
-	/* encoding, err := (*encorder).GuessCharset(ff.path, 128)
+	return ff.load("")
+}
+
+// LoadWithCharset loads the file decoding it from charset instead of guessing the charset
+func (ff *File) LoadWithCharset(charset string) error {
+	if charset != defaultCharset && GetEncoder(charset) == nil {
+		return fmt.Errorf("unknown charset %s", charset)
+	}
+	return ff.load(charset)
+}
+
+// ReadFromDisk returns the content of the file on disk decoded from the charset of the buffer
+func (ff *File) ReadFromDisk() ([]byte, error) {
+	data, err := os.ReadFile(ff.path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if _, _, err := decode(&data, ff.encoding); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Decode data to UTF-8, guess the charset if charset is empty
+// message is the message of the Encoder that decoded the data
+func decode(data *[]byte, charset string) (encoder Encoder, message error, err error) {
+	encoder = GetEncoder(charset)
+	if charset == "" {
+		encoder = guessEncoder(*data)
 	}
-	ff.encoding = encoding */
+	if encoder != nil {
+		if err := encoder.Decoder(data); err != nil {
+			if !encoder.IsDecodedMessage(err) {
+				return nil, nil, err
+			}
+			message = err
+		}
+	}
+	return encoder, message, nil
+}
 
-	fp, err := os.Open(ff.path)
+// ReadDecoded reads the file at path decoded to UTF-8 as Load does, guessing its charset
+func ReadDecoded(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := decode(&data, ""); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// SplitLines splits decoded data into the rows of Load, on LF, CRLF and a lone CR
+// The lines are without their linefeeds
+func SplitLines(data []byte) [][]byte {
+	lines := [][]byte{}
+	for len(data) > 0 {
+		i := bytes.IndexAny(data, "\r\n")
+		if i < 0 {
+			lines = append(lines, data)
+			break
+		}
+		lines = append(lines, data[:i])
+		if data[i] == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+			i++
+		}
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// Guess the charset if charset is empty
+func (ff *File) load(charset string) error {
+	data, err := os.ReadFile(ff.path)
 	if err != nil {
 		return err
 	}
-	defer fp.Close()
-	scanLines := newScanLines(ff.encoding)
-	scanner := bufio.NewScanner(fp)
-	scanner.Split(scanLines.scanLines)
+	diskSum := sha256.Sum256(data)
+	encoder, message, err := decode(&data, charset)
+	if err != nil {
+		return err
+	}
+	ff.encoding = defaultCharset
+	ff.decodedMessage = message
+	if encoder != nil {
+		ff.encoding = encoder.Charset()
+	}
+
 	// ff.rows__ = NewRows()
 	//
 	// ff.RowsStruct.New()
 	ff.RowsStruct = rows.New()
-	for scanner.Scan() {
-		line := scanner.Bytes() // Not reallocate
-
-		//row := NewRow()
-		//row.bytes(line)
-		//ff.rows__.append(row)
-
-		// allocate to buffer
-		b := make([]byte, 0, len(line))
-		b = append(b, line...)
-		ff.Rows().Add(b)
-	}
-	err = scanner.Err()
-	if err != nil && err != io.EOF {
+	loaded, terminators, scanLines, err := scanRows(data)
+	if err != nil {
 		return err
 	}
+	ff.SetRows(loaded) // Build the rope at once
 
 	// var row *Row__
 	// if the file size is zero
@@ -307,7 +457,7 @@ func (ff *File) Load() error {
 		if ch, _, _ := ff.Rows().Row(linesIndex).DecodeRune(lineIndex - 1); ch == '\n' {
 			ff.Rows().Add([]byte{define.EOF})
 		} else {
-			ff.Rows().Row(linesIndex).Add([]byte{define.EOF})
+			ff.Rows().SetRow(linesIndex, append(ff.Rows().Row(linesIndex).Bytes(), define.EOF))
 		}
 	}
 	/*
@@ -322,7 +472,16 @@ func (ff *File) Load() error {
 	// verb.PP("%d,%d", linesIndex, lineIndex-1)
 
 	// Set linefeed type
-	ff.linefeed = []linefeed{LF, CRLF, CR}[utils.MaxValueIndex([]int{scanLines.countLF, scanLines.countCRLF, scanLines.countCR})]
+	ff.linefeed = scanLines.mostUsed()
+	// Keep the original terminator of each row if the file has mixed linefeeds
+	ff.mixedLinefeed = scanLines.mixed()
+	if ff.mixedLinefeed {
+		for i, t := range terminators {
+			ff.Rows().SetTerminator(i, uint8(t))
+		}
+	}
+	ff.stat(ff.path)
+	ff.diskSum = diskSum
 
 	// dump
 	/*
@@ -337,6 +496,33 @@ func (ff *File) Load() error {
 	return nil
 }
 
+// Split data decoded to UTF-8 into rows ending with LF
+// Return the original terminator of each row, 0 for the last row if it is not terminated
+func scanRows(data []byte) ([][]byte, []linefeed, *scanLines_, error) {
+	scanLines := newScanLines()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Split(scanLines.scanLines)
+	loaded := make([][]byte, 0, 64)
+	terminators := make([]linefeed, 0, 64)
+	for scanner.Scan() {
+		line := scanner.Bytes() // Not reallocate
+
+		//row := NewRow()
+		//row.bytes(line)
+		//ff.rows__.append(row)
+
+		// allocate to buffer
+		b := make([]byte, 0, len(line))
+		b = append(b, line...)
+		loaded = append(loaded, b)
+		terminators = append(terminators, scanLines.linefeed)
+	}
+	if err := scanner.Err(); err != nil && err != io.EOF {
+		return nil, nil, nil, err
+	}
+	return loaded, terminators, scanLines, nil
+}
+
 func (ff *File) SetLangMode(langMode *lang.Mode) {
 	ff.langMode = langMode
 }
@@ -368,24 +554,41 @@ func (ff *File) Save() (results error) {
 		if err == nil {
 			// Add EOF Mark and split formatted source
 			formattedRows := bytes.SplitAfter(append(formatted, define.EOF), []byte("\n"))
-			ff.SetRows(formattedRows)
+			ff.SetRows(formattedRows) // Formatting normalizes mixed linefeeds
+			ff.mixedLinefeed = false
 			results = errors.Join(results, gecore.NewGeError(ErrFormatted, "formatted"))
 		}
 	}
 
-	var sb strings.Builder // Consider using strings.Builder for potential performance gains
+	data, err := ff.linefeedBytes()
+	if err != nil {
+		return errors.Join(results, err)
+	}
+	if encoder := GetEncoder(ff.encoding); encoder != nil {
+		if err := encoder.Encoder(&data); err != nil {
+			return errors.Join(results, fmt.Errorf("%s: %w", ff.encoding, err))
+		}
+	}
 
-	linefeed := []byte{'\n'} // Default to LF
-	if ff.linefeed&CRLF > 0 {
-		linefeed = []byte{'\r', '\n'}
-	} else if ff.linefeed&CR > 0 {
-		linefeed = []byte{'\r'}
+	// ErrSaved is reported only after the data is durable on disk
+	err = writeFile(ff.path, data)
+	if err == nil {
+		ff.stat(ff.path)
+		ff.diskSum = sha256.Sum256(data)
+		ff.RemoveRecovery()
+		err = gecore.NewGeError(ErrSaved, "saved")
 	}
+	return errors.Join(results, err)
+}
+
+// Content written on Save before it is encoded, each row ends with its own linefeed and the EOF mark is removed
+func (ff *File) linefeedBytes() ([]byte, error) {
+	var sb strings.Builder // Consider using strings.Builder for potential performance gains
 
 	lastRowIndex := ff.RowsLength() - 1
-	for i, row := range *ff.Rows() {
+	for i, row := range ff.BytesArray() {
 		if row == nil {
-			return errors.Join(results, fmt.Errorf("row is nothing"))
+			return nil, fmt.Errorf("row is nothing")
 		}
 		lineBufferLen := ff.Rows().Row(i).Length()
 		if i == lastRowIndex && row[lineBufferLen-1] == define.EOF {
@@ -393,29 +596,13 @@ func (ff *File) Save() (results error) {
 			sb.Write(row[:lineBufferLen-1])
 			break
 		} else if row[lineBufferLen-1] == define.LF {
-			sb.Write(row[:lineBufferLen-1]) // skip linefeed and
-			sb.Write(linefeed)              // append
+			sb.Write(row[:lineBufferLen-1])     // skip linefeed and
+			sb.Write(ff.rowLinefeed(i).bytes()) // append
 		} else {
 			sb.Write(row[:lineBufferLen])
 		}
 	}
-
-	err := os.WriteFile(ff.path, []byte(sb.String()), 0644)
-	if err == nil {
-		err = gecore.NewGeError(ErrSaved, "saved")
-	}
-	return errors.Join(results, err)
-}
-
-// would like to consider other formats such as dates.
-func (ff *File) Backup() error {
-	for i := 1; i < 1_000_000; i++ {
-		backup := fmt.Sprintf("%s.~%d~", ff.path, i)
-		if !utils.ExistsFile(backup) {
-			return utils.CopyFile(ff.path, backup)
-		}
-	}
-	return fmt.Errorf("too many backups")
+	return []byte(sb.String()), nil
 }
 
 // Setter/Getter
@@ -447,14 +634,117 @@ func (ff *File) GetEncoding() string {
 	return ff.encoding
 }
 
+// Return the message of the Encoder that decoded the file, nil if not decoded
+func (ff *File) GetDecodedMessage() error {
+	return ff.decodedMessage
+}
+
+// Set the charset used to encode the file on Save
+func (ff *File) SetEncoding(charset string) error {
+	if charset != defaultCharset && GetEncoder(charset) == nil {
+		return fmt.Errorf("unknown charset %s", charset)
+	}
+	ff.encoding = charset
+	return nil
+}
+
+// Return "LF", "CRLF", "CR" or MixedLinefeed
 func (ff *File) GetLinefeed() string {
-	if ff.linefeed&LF > 0 {
-		return "LF"
+	if ff.mixedLinefeed {
+		return MixedLinefeed
 	}
-	if ff.linefeed&CRLF > 0 {
-		return "CRLF"
+	return ff.linefeed.String()
+}
+
+// Return the linefeed written on Save for the row, "LF", "CRLF" or "CR"
+func (ff *File) GetRowLinefeed(rowIndex int) string {
+	return ff.rowLinefeed(rowIndex).String()
+}
+
+func (ff *File) rowLinefeed(rowIndex int) linefeed {
+	if t := linefeed(ff.Rows().Terminator(rowIndex)); t != 0 {
+		return t
+	}
+	return ff.linefeed
+}
+
+// Set the linefeed written on Save, "LF", "CRLF" or "CR".
+// Mixed linefeeds are normalized to it.
+func (ff *File) SetLinefeed(lf string) error {
+	switch lf {
+	case "LF":
+		ff.linefeed = LF
+	case "CRLF":
+		ff.linefeed = CRLF
+	case "CR":
+		ff.linefeed = CR
+	default:
+		return fmt.Errorf("unknown linefeed %s", lf)
+	}
+	if ff.mixedLinefeed {
+		for i := 0; i < ff.RowsLength(); i++ {
+			ff.Rows().SetTerminator(i, 0)
+		}
+		ff.mixedLinefeed = false
+	}
+	return nil
+}
+
+// Return the linefeed written on Save for rows without their own terminator, "LF", "CRLF" or "CR"
+func (ff *File) GetDefaultLinefeed() string {
+	return ff.linefeed.String()
+}
+
+// Return the terminator of each row if the file has mixed linefeeds, otherwise nil.
+// Restore them with SetRowLinefeeds.
+func (ff *File) GetRowLinefeeds() []byte {
+	if !ff.mixedLinefeed {
+		return nil
+	}
+	terminators := make([]byte, ff.RowsLength())
+	for i := range terminators {
+		terminators[i] = ff.Rows().Terminator(i)
+	}
+	return terminators
+}
+
+// Restore the default linefeed returned by GetDefaultLinefeed and the terminators returned by GetRowLinefeeds
+// The linefeeds are not mixed if terminators is nil
+func (ff *File) SetRowLinefeeds(lf string, terminators []byte) error {
+	if err := ff.SetLinefeed(lf); err != nil {
+		return err
+	}
+	if terminators == nil {
+		return nil
 	}
-	return "CR"
+	ff.SetTerminators(0, terminators)
+	ff.mixedLinefeed = true
+	return nil
+}
+
+// Return the terminators of the linefeeds between start and stop, one per row from start, if the file has mixed linefeeds.
+// Otherwise nil. Restore them with SetTerminators after inserting the text again.
+func (ff *File) GetTerminators(start, stop Cursor) []byte {
+	if !ff.mixedLinefeed || stop.RowIndex <= start.RowIndex {
+		return nil
+	}
+	terminators := make([]byte, 0, stop.RowIndex-start.RowIndex)
+	for i := start.RowIndex; i < stop.RowIndex; i++ {
+		terminators = append(terminators, ff.Rows().Terminator(i))
+	}
+	return terminators
+}
+
+// Set the terminators of the rows from rowIndex
+func (ff *File) SetTerminators(rowIndex int, terminators []byte) {
+	for i := 0; i < len(terminators) && rowIndex+i < ff.RowsLength(); i++ {
+		ff.Rows().SetTerminator(rowIndex+i, terminators[i])
+	}
+}
+
+// GetLinefeeds returns the linefeeds that can be set with SetLinefeed
+func GetLinefeeds() []string {
+	return []string{"LF", "CRLF", "CR"}
 }
 
 func (ff *File) GetTabWidth() int {
@@ -475,6 +765,18 @@ func (ff *File) IsReadonly() bool {
 	return ff.flags&READONLY > 0
 }
 
+func (ff *File) SetScratch(b bool) {
+	if b {
+		ff.flags |= SCRATCH
+	} else {
+		ff.flags &= ^SCRATCH
+	}
+}
+
+func (ff *File) IsScratch() bool {
+	return ff.flags&SCRATCH > 0
+}
+
 /*
 	 func (ff *File) SetDirtyFlag(b bool) {
 		if b {
@@ -0,0 +1,188 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	recoveryDir   = cacheDir("recovery")
+	recoveryMutex sync.RWMutex
+	// Autosave writes crash-recovery files in the background, writing and removing them is serialized
+	recoveryFileMutex sync.Mutex
+)
+
+// Default directory of files kept across sessions
+func cacheDir(name string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "ge-editor", name)
+}
+
+// SetRecoveryDir sets the directory of crash-recovery files, empty disables them
+func SetRecoveryDir(dir string) {
+	recoveryMutex.Lock()
+	defer recoveryMutex.Unlock()
+	recoveryDir = dir
+}
+
+func GetRecoveryDir() string {
+	recoveryMutex.RLock()
+	defer recoveryMutex.RUnlock()
+	return recoveryDir
+}
+
+// Path of the crash-recovery file, empty if disabled
+func (ff *File) recoveryPath() string {
+	dir := GetRecoveryDir()
+	if dir == "" || ff.IsScratch() {
+		return ""
+	}
+	return filepath.Join(dir, manglePath(ff.path)+".recover")
+}
+
+// WriteRecovery writes the buffer content to the crash-recovery file
+// Nothing is written if the content is the same as the last time
+func (ff *File) WriteRecovery() error {
+	if write := ff.recoveryWriter(); write != nil {
+		return write()
+	}
+	return nil
+}
+
+// Snapshot the buffer content and return the function writing it to the crash-recovery file
+// nil if the content was written already
+func (ff *File) recoveryWriter() func() error {
+	path := ff.recoveryPath()
+	if path == "" {
+		return nil
+	}
+	if ff.recoveryWritten && ff.recoveryRows == ff.RowsStruct && ff.recoveryVersion == ff.Version() {
+		return nil
+	}
+	// Written in the linefeeds of the file, ReadRecovery returns them
+	content, err := ff.linefeedBytes()
+	if err != nil {
+		return func() error { return err }
+	}
+
+	ff.recoveryWritten = true
+	ff.recoveryRows, ff.recoveryVersion = ff.RowsStruct, ff.Version()
+	seq := ff.recoverySeq.Add(1)
+	return func() error {
+		recoveryFileMutex.Lock()
+		defer recoveryFileMutex.Unlock()
+		if ff.recoverySeq.Load() != seq {
+			return nil // Written or removed again since
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		return writeFile(path, content)
+	}
+}
+
+// Autosave returns the function writing the crash-recovery file of a dirty buffer, or removing it when the buffer is clean
+// The content is taken at once, the function may run in the background. nil if there is nothing to do
+// A crash-recovery file left by another session is kept until it is restored or removed
+func (ff *File) Autosave() func() error {
+	if ff.UndoAction.IsDirty() {
+		if ff.HasRecovery() {
+			return nil
+		}
+		return ff.recoveryWriter()
+	}
+	if ff.recoveryWritten {
+		return ff.recoveryRemover()
+	}
+	return nil
+}
+
+// RemoveRecovery removes the crash-recovery file, if any
+func (ff *File) RemoveRecovery() error {
+	if remove := ff.recoveryRemover(); remove != nil {
+		return remove()
+	}
+	return nil
+}
+
+// Return the function removing the crash-recovery file, nil if disabled
+func (ff *File) recoveryRemover() func() error {
+	ff.recoveryWritten = false
+	path := ff.recoveryPath()
+	if path == "" {
+		return nil
+	}
+	seq := ff.recoverySeq.Add(1)
+	return func() error {
+		recoveryFileMutex.Lock()
+		defer recoveryFileMutex.Unlock()
+		if ff.recoverySeq.Load() != seq {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+}
+
+// RemoveStaleRecovery removes a crash-recovery file older than the file on disk, which HasRecovery ignores
+func (ff *File) RemoveStaleRecovery() error {
+	path := ff.recoveryPath()
+	if path == "" || ff.recoveryWritten || !ff.onDisk {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.ModTime().After(ff.modTime) {
+		return nil
+	}
+	return ff.RemoveRecovery()
+}
+
+// HasRecovery reports whether a crash-recovery file left by another session is newer than the file on disk
+func (ff *File) HasRecovery() bool {
+	path := ff.recoveryPath()
+	if path == "" || ff.recoveryWritten {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return !ff.onDisk || info.ModTime().After(ff.modTime)
+}
+
+// ReadRecovery returns the content of the crash-recovery file with LF linefeeds
+// Restore its linefeeds with SetRowLinefeeds(lf, terminators) after SetContent
+func (ff *File) ReadRecovery() (data []byte, lf string, terminators []byte, err error) {
+	path := ff.recoveryPath()
+	if path == "" {
+		return nil, "", nil, fs.ErrNotExist
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	loaded, rowTerminators, scanLines, err := scanRows(content)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	lf = ff.linefeed.String() // Kept if the content has no linefeed
+	if scanLines.countLF+scanLines.countCRLF+scanLines.countCR > 0 {
+		lf = scanLines.mostUsed().String()
+	}
+	if scanLines.mixed() {
+		terminators = make([]byte, len(rowTerminators))
+		for i, t := range rowTerminators {
+			terminators[i] = uint8(t)
+		}
+	}
+	return bytes.Join(loaded, nil), lf, terminators, nil
+}
@@ -0,0 +1,185 @@
+package rows
+
+import "slices"
+
+const (
+	maxChunkRows = 512              // Split a leaf above this number of rows
+	minChunkRows = maxChunkRows / 4 // Coalesce leaves below this number of rows when rebuilding
+	balanceAlpha = 0.7              // Rebuild a subtree when a child holds more leaves than this ratio
+)
+
+// Row held in a leaf of the rope
+type entry struct {
+	row        []byte
+	terminator uint8 // Kind of the line terminator, interpreted by the caller. 0 if not set
+}
+
+// node of the rope.
+// A leaf holds a chunk of rows, a branch holds two children.
+type node struct {
+	left, right *node
+	chunk       []entry // leaf only
+
+	length int // number of rows in the subtree
+	leaves int // number of leaves in the subtree
+}
+
+func newLeaf(chunk []entry) *node {
+	return &node{chunk: chunk, length: len(chunk), leaves: 1}
+}
+
+func newBranch(left, right *node) *node {
+	n := &node{left: left, right: right}
+	n.update()
+	return n
+}
+
+func (n *node) isLeaf() bool {
+	return n.left == nil
+}
+
+func (n *node) update() {
+	n.length = n.left.length + n.right.length
+	n.leaves = n.left.leaves + n.right.leaves
+}
+
+// locate returns the leaf holding rowIndex and the index within the leaf chunk
+func (n *node) locate(rowIndex int) (*node, int) {
+	for !n.isLeaf() {
+		if rowIndex < n.left.length {
+			n = n.left
+		} else {
+			rowIndex -= n.left.length
+			n = n.right
+		}
+	}
+	return n, rowIndex
+}
+
+// insert data at rowIndex and return the new subtree
+func (n *node) insert(rowIndex int, data []byte) *node {
+	if n.isLeaf() {
+		n.chunk = slices.Insert(n.chunk, rowIndex, entry{row: data})
+		n.length = len(n.chunk)
+		if n.length <= maxChunkRows {
+			return n
+		}
+		half := n.length / 2
+		// Clip the left chunk so that appending to it never overwrites the right chunk
+		return newBranch(newLeaf(slices.Clip(n.chunk[:half])), newLeaf(n.chunk[half:]))
+	}
+
+	if rowIndex <= n.left.length {
+		n.left = n.left.insert(rowIndex, data)
+	} else {
+		n.right = n.right.insert(rowIndex-n.left.length, data)
+	}
+	n.update()
+	return n.balance()
+}
+
+// delete rows[from:to] and return the new subtree, nil if the subtree became empty
+func (n *node) delete(from, to int) *node {
+	if from <= 0 && to >= n.length {
+		return nil
+	}
+	if n.isLeaf() {
+		n.chunk = slices.Delete(n.chunk, from, to)
+		n.length = len(n.chunk)
+		return n
+	}
+
+	leftLength := n.left.length
+	if from < leftLength {
+		n.left = n.left.delete(from, min(to, leftLength))
+	}
+	if to > leftLength {
+		n.right = n.right.delete(max(from-leftLength, 0), to-leftLength)
+	}
+	if n.left == nil {
+		return n.right
+	}
+	if n.right == nil {
+		return n.left
+	}
+	n.update()
+	return n.balance()
+}
+
+// balance rebuilds the subtree if one side has grown too heavy (scapegoat rebuild).
+// Rebuilding is O(leaves) but happens rarely enough that edits stay O(log n) amortized.
+func (n *node) balance() *node {
+	if n.leaves < 4 {
+		return n
+	}
+	if float64(max(n.left.leaves, n.right.leaves)) <= balanceAlpha*float64(n.leaves) {
+		return n
+	}
+	return build(coalesce(n.chunks(nil)))
+}
+
+// chunks appends the leaf chunks of the subtree in order
+func (n *node) chunks(dst [][]entry) [][]entry {
+	if n.isLeaf() {
+		if len(n.chunk) > 0 {
+			dst = append(dst, n.chunk)
+		}
+		return dst
+	}
+	return n.right.chunks(n.left.chunks(dst))
+}
+
+// flatten returns all rows of the subtree as one slice
+func (n *node) flatten() [][]byte {
+	if n == nil {
+		return [][]byte{}
+	}
+	r := make([][]byte, 0, n.length)
+	for _, chunk := range n.chunks(nil) {
+		for _, e := range chunk {
+			r = append(r, e.row)
+		}
+	}
+	return r
+}
+
+// build a balanced tree from the leaf chunks
+func build(chunks [][]entry) *node {
+	switch len(chunks) {
+	case 0:
+		return nil
+	case 1:
+		return newLeaf(chunks[0])
+	}
+	mid := len(chunks) / 2
+	return newBranch(build(chunks[:mid]), build(chunks[mid:]))
+}
+
+// split rows into leaf chunks
+func split(r [][]byte) [][]entry {
+	chunks := make([][]entry, 0, len(r)/maxChunkRows+1)
+	for i := 0; i < len(r); i += maxChunkRows {
+		chunk := make([]entry, 0, min(maxChunkRows, len(r)-i))
+		for _, row := range r[i:min(i+maxChunkRows, len(r))] {
+			chunk = append(chunk, entry{row: row})
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// coalesce merges small adjacent chunks so that deletions do not leave many tiny leaves
+func coalesce(chunks [][]entry) [][]entry {
+	merged := chunks[:0]
+	for _, chunk := range chunks {
+		if l := len(merged); l > 0 {
+			last := merged[l-1]
+			if (len(last) < minChunkRows || len(chunk) < minChunkRows) && len(last)+len(chunk) <= maxChunkRows {
+				merged[l-1] = append(slices.Clip(last), chunk...)
+				continue
+			}
+		}
+		merged = append(merged, chunk)
+	}
+	return merged
+}
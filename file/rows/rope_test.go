@@ -0,0 +1,237 @@
+package rows
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+func rowsOf(n int) [][]byte {
+	r := make([][]byte, n)
+	for i := range r {
+		r[i] = []byte(fmt.Sprintf("%d\n", i))
+	}
+	return r
+}
+
+// check compares the rows with want and the cached counts of every node
+func check(t *testing.T, rs *RowsStruct, want [][]byte) {
+	t.Helper()
+	r := rs.Rows()
+	if r.Length() != len(want) {
+		t.Fatalf("Length() = %d, want %d", r.Length(), len(want))
+	}
+	for i := range want {
+		if got := r.Row(i).Bytes(); !bytes.Equal(got, want[i]) {
+			t.Fatalf("Row(%d) = %q, want %q", i, got, want[i])
+		}
+	}
+	flat := rs.BytesArray()
+	if len(flat) != len(want) {
+		t.Fatalf("len(BytesArray()) = %d, want %d", len(flat), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(flat[i], want[i]) {
+			t.Fatalf("BytesArray()[%d] = %q, want %q", i, flat[i], want[i])
+		}
+	}
+	if r.root != nil {
+		checkNode(t, r.root)
+	}
+}
+
+func checkNode(t *testing.T, n *node) (length, leaves int) {
+	t.Helper()
+	if n.isLeaf() {
+		if len(n.chunk) > maxChunkRows {
+			t.Fatalf("leaf of %d rows", len(n.chunk))
+		}
+		length, leaves = len(n.chunk), 1
+	} else {
+		l, lv := checkNode(t, n.left)
+		r, rv := checkNode(t, n.right)
+		length, leaves = l+r, lv+rv
+	}
+	if n.length != length || n.leaves != leaves {
+		t.Fatalf("node counts %d rows %d leaves, want %d rows %d leaves", n.length, n.leaves, length, leaves)
+	}
+	return length, leaves
+}
+
+func depth(n *node) int {
+	if n == nil || n.isLeaf() {
+		return 0
+	}
+	return 1 + max(depth(n.left), depth(n.right))
+}
+
+func TestInsert(t *testing.T) {
+	tests := []struct {
+		name  string
+		index func(i int) int // Index to insert the i-th row at
+	}{
+		{"append", func(i int) int { return i }},
+		{"prepend", func(i int) int { return 0 }},
+		{"middle", func(i int) int { return i / 2 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := New()
+			want := [][]byte{}
+			for i := range 3 * maxChunkRows {
+				row := []byte(fmt.Sprintf("%d\n", i))
+				index := tt.index(i)
+				if !rs.Rows().InsertRow(index, row) {
+					t.Fatalf("InsertRow(%d) failed", index)
+				}
+				want = append(want[:index], append([][]byte{row}, want[index:]...)...)
+			}
+			check(t, rs, want)
+		})
+	}
+
+	rs := New()
+	if rs.Rows().InsertRow(1, []byte("x")) || rs.Rows().InsertRow(-1, []byte("x")) {
+		t.Error("InsertRow out of range succeeded")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	const n = 4 * maxChunkRows
+	tests := []struct {
+		name     string
+		from, to int
+	}{
+		{"first row", 0, 1},
+		{"last row", n - 1, n},
+		{"within a leaf", 10, 20},
+		{"across leaves", maxChunkRows - 5, 2*maxChunkRows + 5},
+		{"whole leaves", maxChunkRows, 3 * maxChunkRows},
+		{"all", 0, n},
+		{"clamped", -5, 3},
+		{"empty range", 7, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := New()
+			rs.SetRows(rowsOf(n))
+			want := rowsOf(n)
+			rs.Rows().Delete(tt.from, tt.to)
+			if tt.from < tt.to {
+				want = append(want[:max(tt.from, 0)], want[min(tt.to, n):]...)
+			}
+			check(t, rs, want)
+		})
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	rs := New()
+	rs.SetRows(rowsOf(16 * maxChunkRows))
+	// Growing one side makes the tree lean until a subtree is rebuilt
+	inserted := [][]byte{}
+	for i := range 16 * maxChunkRows {
+		row := []byte(fmt.Sprintf("new %d\n", i))
+		rs.Rows().InsertRow(0, row)
+		inserted = append(inserted, row)
+	}
+	slices.Reverse(inserted)
+	want := append(inserted, rowsOf(16*maxChunkRows)...)
+	check(t, rs, want)
+	leaves := rs.Rows().root.leaves
+	if d := depth(rs.Rows().root); d > 3*bitLength(leaves) {
+		t.Errorf("depth %d for %d leaves", d, leaves)
+	}
+
+	// Deleting most rows coalesces the small leaves left behind
+	for rs.Rows().Length() > maxChunkRows {
+		rs.Rows().Delete(1, 1+maxChunkRows/2)
+		want = append(want[:1], want[1+maxChunkRows/2:]...)
+	}
+	check(t, rs, want)
+}
+
+func bitLength(n int) int {
+	l := 0
+	for ; n > 0; n >>= 1 {
+		l++
+	}
+	return l
+}
+
+func TestRandomEdits(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	rs := New()
+	want := [][]byte{}
+	for i := range 20000 {
+		switch op := r.Intn(10); {
+		case op < 5 || len(want) == 0:
+			index := r.Intn(len(want) + 1)
+			row := []byte(fmt.Sprintf("%d\n", i))
+			rs.Rows().InsertRow(index, row)
+			want = append(want[:index], append([][]byte{row}, want[index:]...)...)
+		case op < 8:
+			from := r.Intn(len(want))
+			to := min(from+r.Intn(2*maxChunkRows), len(want))
+			rs.Rows().Delete(from, to)
+			want = append(want[:from], want[to:]...)
+		default:
+			index := r.Intn(len(want))
+			row := []byte(fmt.Sprintf("set %d\n", i))
+			rs.Rows().SetRow(index, row)
+			want[index] = row
+		}
+		if i%500 == 0 {
+			check(t, rs, want)
+		}
+	}
+	check(t, rs, want)
+}
+
+func TestTerminator(t *testing.T) {
+	rs := New()
+	rs.SetRows(rowsOf(3 * maxChunkRows))
+	r := rs.Rows()
+	for i := range r.Length() {
+		r.SetTerminator(i, uint8(i%3))
+	}
+	// Rows keep their terminators when the rows around them move
+	r.InsertRow(0, []byte("x\n"))
+	r.Delete(maxChunkRows, maxChunkRows+10)
+	for i := 1; i < r.Length(); i++ {
+		old := i - 1
+		if i >= maxChunkRows {
+			old += 10
+		}
+		if got := r.Terminator(i); got != uint8(old%3) {
+			t.Fatalf("Terminator(%d) = %d, want %d", i, got, old%3)
+		}
+	}
+	if r.Terminator(0) != 0 || r.Terminator(-1) != 0 || r.Terminator(r.Length()) != 0 {
+		t.Error("inserted or out of range terminator is not 0")
+	}
+}
+
+func TestBytesArrayCache(t *testing.T) {
+	rs := New()
+	rs.SetRows(rowsOf(10))
+	want := rowsOf(10)
+	first := rs.BytesArray()
+	if second := rs.BytesArray(); &first[0] != &second[0] {
+		t.Error("BytesArray flattened again without an edit")
+	}
+
+	rs.Rows().SetRow(3, []byte("three\n"))
+	want[3] = []byte("three\n")
+	check(t, rs, want)
+	rs.Rows().InsertRow(5, []byte("five\n"))
+	want = append(want[:5], append([][]byte{[]byte("five\n")}, want[5:]...)...)
+	check(t, rs, want)
+	rs.Rows().Delete(0, 2)
+	want = want[2:]
+	check(t, rs, want)
+	rs.SetRows(rowsOf(2))
+	check(t, rs, rowsOf(2))
+}
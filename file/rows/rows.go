@@ -82,85 +82,146 @@ func (r *row) DecodePrevRune(colIndex int) (ch rune, size, i int, ok bool) {
 // **********************************
 
 type RowsStruct struct {
-	rows [][]byte
+	rows rows
 }
 
-// New creates a new buffer with an initial capacity of 64
+// New creates a new empty buffer
 func New() *RowsStruct {
-	return &RowsStruct{
-		rows: make([][]byte, 0, 64),
-	}
+	return &RowsStruct{}
 }
 
 func (rs *RowsStruct) Rows() *rows {
-	return (*rows)(&rs.rows)
+	return &rs.rows
 }
 
-func (rs *RowsStruct) SetRows(r rows) {
-	rs.rows = r
+// SetRows replaces all rows, terminators of the rows are reset to 0
+func (rs *RowsStruct) SetRows(r [][]byte) {
+	rs.rows.root = build(split(r))
+	rs.rows.edited()
 }
 
+// BytesArray returns all rows as a flat [][]byte.
+// The slice is kept until the next edit of the rows and must not be modified.
 func (rs *RowsStruct) BytesArray() [][]byte {
-	return (*rs).rows
+	return rs.rows.flatten()
+}
+
+// Version counts the edits of the rows, it changes whenever the content does
+func (rs *RowsStruct) Version() uint64 {
+	return rs.rows.version
 }
 
 func (rs *RowsStruct) Bytes() ([]byte, []int, error) {
-	return utils.JoinBytes((*rs).rows)
+	return utils.JoinBytes(rs.BytesArray())
 }
 
 // RowsLength returns the number of lines
 func (rs *RowsStruct) RowsLength() int {
-	return len((*rs).rows)
+	return rs.rows.Length()
 }
 
 // **********************************
 
-type rows [][]byte
+// rows is a rope of rows.
+// Inserting or deleting rows costs O(log n) instead of moving the whole slice.
+type rows struct {
+	root    *node
+	flat    [][]byte // All rows flattened on demand, nil after an edit
+	version uint64   // Number of edits
+}
 
+// Row returns the row at rowIndex.
+// Change the row with SetRow, changes through the returned row are not seen by BytesArray.
 func (r *rows) Row(rowIndex int) *row {
-	return (*row)(&(*r)[rowIndex])
+	leaf, i := r.root.locate(rowIndex)
+	return (*row)(&leaf.chunk[i].row)
 }
 
-// AddRow adds a new []byte to the lines **slices**
+// Terminator returns the kind of line terminator set to the row, 0 if not set
+func (r *rows) Terminator(rowIndex int) uint8 {
+	if rowIndex < 0 || rowIndex >= r.Length() {
+		return 0
+	}
+	leaf, i := r.root.locate(rowIndex)
+	return leaf.chunk[i].terminator
+}
+
+// SetTerminator sets the kind of line terminator of the row.
+// The value is not interpreted by rows, inserted rows start with 0.
+func (r *rows) SetTerminator(rowIndex int, terminator uint8) bool {
+	if rowIndex < 0 || rowIndex >= r.Length() {
+		return false
+	}
+	leaf, i := r.root.locate(rowIndex)
+	leaf.chunk[i].terminator = terminator
+	return true
+}
+
+// AddRow adds a new []byte to the end of lines
 func (r *rows) Add(data []byte) {
-	*r = append(*r, data)
+	r.InsertRow(r.Length(), data)
 }
 
 // delete rows[col1:col2]
 func (r *rows) Delete(col1, col2 int) {
-	*r = slices.Delete(*r, col1, col2)
-	// return slices.Delete(*r, col1, col2)
+	if r.root == nil || col1 >= col2 {
+		return
+	}
+	r.root = r.root.delete(max(col1, 0), min(col2, r.root.length))
+	r.edited()
 }
 
 // InsertRow inserts a new line at the specified index
 func (r *rows) InsertRow(rowIndex int, row []byte) bool {
-	if rowIndex < 0 || rowIndex > len(*r) {
+	if rowIndex < 0 || rowIndex > r.Length() {
 		return false
 	}
-	*r = slices.Insert(*r, rowIndex, row)
+	if r.root == nil {
+		r.root = newLeaf(make([]entry, 0, 64))
+	}
+	r.root = r.root.insert(rowIndex, row)
+	r.edited()
 	return true
 }
 
 // SetRow sets the content of a specific line by index
 func (r *rows) SetRow(rowIndex int, row []byte) bool {
-	if rowIndex < 0 || rowIndex >= len(*r) {
+	if rowIndex < 0 || rowIndex >= r.Length() {
 		return false
 	}
-	(*r)[rowIndex] = row
+	*r.Row(rowIndex) = row
+	r.edited()
 	return true
 }
 
+// edited drops the flattened rows and counts the edit
+func (r *rows) edited() {
+	r.flat = nil
+	r.version++
+}
+
+// flatten returns all rows as one slice, flattening the rope only after an edit
+func (r *rows) flatten() [][]byte {
+	if r.flat == nil {
+		r.flat = r.root.flatten()
+	}
+	return r.flat
+}
+
 func (r *rows) Length() int {
-	return len(*r)
+	if r.root == nil {
+		return 0
+	}
+	return r.root.length
 }
 
 func (r *rows) IsRowIndexLastRow(rowIndex int) bool {
-	return len(*r)-1 == rowIndex
+	return r.Length()-1 == rowIndex
 }
 
 func (r *rows) String(rowIndex int) (string, bool) {
-	if rowIndex < 0 || rowIndex >= len(*r) {
+	if rowIndex < 0 || rowIndex >= r.Length() {
 		return "", false
 	}
-	return string((*r)[rowIndex]), true
+	return string(r.Row(rowIndex).Bytes()), true
 }
@@ -5,53 +5,74 @@ package file
 
 import (
 	"bytes"
+
+	"github.com/ge-editor/utils"
 )
 
-func newScanLines(encoding string) *scanLines_ {
-	return &scanLines_{encoding: encoding}
+func newScanLines() *scanLines_ {
+	return &scanLines_{}
 }
 
 type scanLines_ struct {
 	countLF, countCRLF, countCR int
-	encoding                    string
+	linefeed                    linefeed // Linefeed of the last returned line, 0 if not terminated
+}
+
+// Linefeed counted the most, LF if there is none
+func (sl *scanLines_) mostUsed() linefeed {
+	return []linefeed{LF, CRLF, CR}[utils.MaxValueIndex([]int{sl.countLF, sl.countCRLF, sl.countCR})]
+}
+
+// Whether more than one kind of linefeed was counted
+func (sl *scanLines_) mixed() bool {
+	kinds := 0
+	for _, c := range []int{sl.countLF, sl.countCRLF, sl.countCR} {
+		if c > 0 {
+			kinds++
+		}
+	}
+	return kinds > 1
 }
 
 // scanLines is a split function for a Scanner that returns each line of
 // text, stripped of any trailing end-of-line marker. The returned line may
-// be empty. The end-of-line marker is one optional carriage return followed
-// by one mandatory newline. In regular expression notation, it is `\r?\n`.
+// be empty. The end-of-line marker is LF, CRLF or a lone CR.
+// In regular expression notation, it is `\r\n|\r|\n`.
 // The last non-empty line of input will be returned even if it has no
 // newline.
 //
 // Convert the newline code to LF and leave it at the end of the line
 // Count the types of newline codes
-// Line feed codes correspond to LF and CRLF as in the original source
+// The original newline code of the returned line is kept in scanLines_.linefeed
+// data must already be decoded to UTF-8, see File.Load
 func (sl *scanLines_) scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	if atEOF && len(data) == 0 {
 		return 0, nil, nil
 	}
 
-	/* if err = (*encorder).Encoder(sl.encoding, &data); err != nil {
-		return 0, nil, err
-	} */
-
-	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
 		// We have a full newline-terminated line.
-		if i > 0 && data[i-1] == '\r' {
-			sl.countCRLF++
-			data = append(data[0:i-1], '\n')
-		} else {
+		if data[i] == '\n' {
 			sl.countLF++
-			data = data[0 : i+1]
+			sl.linefeed = LF
+			return i + 1, data[0 : i+1], nil
+		}
+		if i+1 >= len(data) && !atEOF {
+			// Need the next byte to tell CR from CRLF
+			return 0, nil, nil
 		}
-		return i + 1, data, nil
+		if i+1 < len(data) && data[i+1] == '\n' {
+			sl.countCRLF++
+			sl.linefeed = CRLF
+			return i + 2, append(data[0:i], '\n'), nil
+		}
+		sl.countCR++
+		sl.linefeed = CR
+		return i + 1, append(data[0:i], '\n'), nil
 	}
 	// If we're at EOF, we have a final, non-terminated line. Return it.
 	if atEOF {
-		if len(data) > 0 && data[len(data)-1] == '\r' {
-			sl.countCR++
-			data = append(data[0:len(data)-1], '\n')
-		}
+		sl.linefeed = 0
 		return len(data), data, nil
 		// const EOF = 0x1a
 		// return len(data), append(data, 0x1a), nil
@@ -0,0 +1,166 @@
+package file
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const undoStoreVersion = 3
+
+var (
+	undoDir   = cacheDir("undo")
+	undoMutex sync.RWMutex
+)
+
+// SetUndoDir sets the directory of persistent undo histories, empty disables them
+func SetUndoDir(dir string) {
+	undoMutex.Lock()
+	defer undoMutex.Unlock()
+	undoDir = dir
+}
+
+func GetUndoDir() string {
+	undoMutex.RLock()
+	defer undoMutex.RUnlock()
+	return undoDir
+}
+
+// Stored undo tree of a file
+type undoStore struct {
+	Version int
+	Path    string
+	Sum     string      // Hash of the file on disk
+	Saved   int         // Index in Nodes of the state of the file on disk, -1 for the root
+	Root    undoEntry   // Holds no actions
+	Nodes   []undoEntry // Parents come before their children
+}
+
+type undoEntry struct {
+	Parent  int // Index in Nodes, -1 for the root
+	Active  int // Index in children of the branch followed by Redo
+	Seq     int // Creation order
+	Time    time.Time
+	Group   bool // EditGroup, EditAction otherwise
+	Actions []*EditAction
+}
+
+// Path of the undo store, empty if disabled
+func (ff *File) undoPath() string {
+	dir := GetUndoDir()
+	if dir == "" || ff.IsScratch() {
+		return ""
+	}
+	return filepath.Join(dir, manglePath(ff.path)+".undo")
+}
+
+// SaveUndo stores the undo tree keyed by the path and the content of the file on disk
+// Nothing is stored if the state of the file on disk in the tree is unknown
+func (ff *File) SaveUndo() error {
+	path := ff.undoPath()
+	u := ff.UndoAction
+	if path == "" || u.saved == nil || !ff.onDisk || ff.IsModifiedOnDisk() {
+		return nil
+	}
+	if len(u.root.children) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	store := undoStore{
+		Version: undoStoreVersion,
+		Path:    ff.path,
+		Sum:     hex.EncodeToString(ff.diskSum[:]),
+		Saved:   -1,
+		Root:    undoEntry{Parent: -1, Active: u.root.active, Time: u.root.time},
+	}
+	indexes := map[*undoNode]int{u.root: -1}
+	u.walk(func(node *undoNode) {
+		if node == u.root {
+			return
+		}
+		entry := undoEntry{Parent: indexes[node.parent], Active: node.active, Seq: node.seq, Time: node.time}
+		switch a := node.undoable.(type) {
+		case *EditAction:
+			entry.Actions = []*EditAction{a}
+		case *EditGroup:
+			entry.Group, entry.Actions = true, a.Actions
+		}
+		indexes[node] = len(store.Nodes)
+		store.Nodes = append(store.Nodes, entry)
+	})
+	store.Saved = indexes[u.saved]
+
+	data, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// LoadUndo restores the undo tree stored by SaveUndo if the file on disk is the same as then
+// The buffer is at the state of the file on disk, later edits are redone with Redo
+func (ff *File) LoadUndo() error {
+	path := ff.undoPath()
+	if path == "" || !ff.onDisk {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var store undoStore
+	if err := json.Unmarshal(data, &store); err != nil {
+		return err
+	}
+	if store.Version != undoStoreVersion || store.Path != ff.path || store.Sum != hex.EncodeToString(ff.diskSum[:]) {
+		return nil // Another file or modified since
+	}
+	if store.Saved < -1 || store.Saved >= len(store.Nodes) {
+		return nil
+	}
+
+	u := &UndoStack{root: &undoNode{active: store.Root.Active, time: store.Root.Time}}
+	nodes := make([]*undoNode, len(store.Nodes))
+	for i, entry := range store.Nodes {
+		if len(entry.Actions) == 0 || entry.Parent < -1 || entry.Parent >= i {
+			return nil
+		}
+		parent := u.root
+		if entry.Parent >= 0 {
+			parent = nodes[entry.Parent]
+		}
+		var undoable Undoable = entry.Actions[0]
+		if entry.Group {
+			undoable = &EditGroup{Actions: entry.Actions}
+		}
+		u.seq = max(u.seq, entry.Seq)
+		nodes[i] = &undoNode{undoable: undoable, parent: parent, active: entry.Active, seq: entry.Seq, time: entry.Time}
+		parent.children = append(parent.children, nodes[i])
+	}
+	for _, node := range append(nodes, u.root) {
+		if node.active < 0 || node.active >= max(len(node.children), 1) {
+			node.active = 0
+		}
+	}
+	u.saved = u.root
+	if store.Saved >= 0 {
+		u.saved = nodes[store.Saved]
+	}
+	u.current = u.saved
+	ff.UndoAction = u
+	return nil
+}
@@ -0,0 +1,121 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const newFileMode fs.FileMode = 0644
+
+// writeFile writes data to path so that the file is either the old or the new content, even on a crash.
+// The data is written to a temporary file in the same directory, synced and renamed over the target.
+//   - A symbolic link is kept, the file it points to is replaced
+//   - Permissions and, where possible, ownership of an existing file are kept
+//   - A file with several hard links is written in place, renaming would detach it from the other links
+func writeFile(path string, data []byte) error {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		target = path // New file
+	}
+
+	info, err := os.Stat(target)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if info != nil && hardLinks(info) > 1 {
+		return writeFileInPlace(target, data)
+	}
+
+	dir, base := filepath.Split(target)
+	// Readable only by the owner until it has the mode of the file it replaces
+	mode := newFileMode
+	if info != nil {
+		mode = 0600
+	}
+	tmp, err := createTempFile(dir, base, mode)
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	removeTemp := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if info != nil {
+		// Change the owner first, chown clears the setuid and setgid bits
+		chown(tmp, info)
+		if err := tmp.Chmod(info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)); err != nil {
+			return removeTemp(err)
+		}
+	}
+	if _, err := tmp.Write(data); err != nil {
+		return removeTemp(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return removeTemp(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, target); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Create a temporary file next to the file to save.
+// A new file is created with newFileMode so that the umask applies to it.
+func createTempFile(dir, base string, mode fs.FileMode) (*os.File, error) {
+	for i := 0; i < 100; i++ {
+		name := filepath.Join(dir, fmt.Sprintf(".%s.%d.tmp", base, time.Now().UnixNano()))
+		fp, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return fp, err
+	}
+	return nil, fmt.Errorf("can not create a temporary file in %s", dir)
+}
+
+func writeFileInPlace(path string, data []byte) error {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// Make the rename durable
+func syncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !isSyncDirUnsupported(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package file
+
+import (
+	"io/fs"
+	"os"
+)
+
+func chown(fp *os.File, info fs.FileInfo) {
+}
+
+func hardLinks(info fs.FileInfo) uint64 {
+	return 1
+}
+
+// A directory can't be synced on Windows
+func isSyncDirUnsupported(err error) bool {
+	return true
+}
@@ -9,6 +9,7 @@ require (
 	github.com/ge-editor/theme v0.1.0
 	github.com/ge-editor/utils v0.1.0
 	github.com/smacker/go-tree-sitter v0.0.0-20240827094217-dd81d9e9be82
+	golang.org/x/text v0.29.0
 )
 
 require (
@@ -18,8 +19,4 @@ require (
 	github.com/rivo/uniseg v0.4.7 // indirect
 	golang.org/x/sys v0.36.0 // indirect
 	golang.org/x/term v0.35.0 // indirect
-	golang.org/x/text v0.29.0 // indirect
 )
-
-
-
@@ -0,0 +1,158 @@
+package grep
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Rule of a .gitignore file
+type rule struct {
+	base    string // Slash separated directory of the .gitignore file relative to the root, "" for the root
+	re      *regexp.Regexp
+	negate  bool // Pattern starting with "!", the path is not ignored
+	dirOnly bool // Pattern ending with "/", matches directories only
+}
+
+// Rules of the .gitignore files read so far, the last matching rule decides
+type ignore struct {
+	rules []rule
+}
+
+// Read the .gitignore file of dir, base is dir relative to the root
+// A missing file has no rules
+func (ig *ignore) read(dir, base string) error {
+	f, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if r, ok := parseRule(scanner.Text(), base); ok {
+			ig.rules = append(ig.rules, r)
+		}
+	}
+	return scanner.Err()
+}
+
+// Whether the slash separated path relative to the root is ignored
+func (ig *ignore) ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, r := range ig.rules {
+		name := rel
+		if r.base != "" {
+			if !strings.HasPrefix(rel, r.base+"/") {
+				continue
+			}
+			name = rel[len(r.base)+1:]
+		}
+		if (r.dirOnly && !isDir) || !r.re.MatchString(name) {
+			continue
+		}
+		ignored = !r.negate
+	}
+	return ignored
+}
+
+// Parse a line of a .gitignore file, ok is false for a blank line or a comment
+func parseRule(line, base string) (r rule, ok bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false
+	}
+	r.base = base
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	line = strings.TrimPrefix(line, `\`) // Escaped "#" or "!"
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	// A pattern with a slash is relative to the .gitignore file, otherwise it matches a name at any level
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return r, false
+	}
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	if !anchored {
+		sb.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case '*':
+			if strings.HasPrefix(line[i:], "**/") {
+				sb.WriteString("(?:.*/)?")
+				i += 2
+			} else if strings.HasPrefix(line[i:], "**") {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(line[i+1:], ']')
+			if j < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := line[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += j + 1
+		case '\\':
+			if i+1 < len(line) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(line[i : i+1]))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return r, false
+	}
+	r.re = re
+	return r, true
+}
+
+// Ignored reports whether Search skips the file at path under root, for a .gitignore rule or a .git directory
+// The file need not exist, such as the file of a buffer not saved yet
+func Ignored(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	ig := &ignore{}
+	ig.read(root, "")
+	names := strings.Split(rel, "/")
+	dir := root
+	for i, name := range names[:len(names)-1] {
+		dir = filepath.Join(dir, name)
+		base := strings.Join(names[:i+1], "/")
+		if name == ".git" || ig.ignored(base, true) {
+			return true
+		}
+		ig.read(dir, base) // A broken .gitignore ignores nothing
+	}
+	return ig.ignored(rel, false)
+}
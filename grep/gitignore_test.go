@@ -0,0 +1,142 @@
+package grep
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnored(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string // Lines of .gitignore files, "base:line" for a file in the directory base
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"name at the root", []string{"*.log"}, "a.log", false, true},
+		{"name at any level", []string{"*.log"}, "d/e/a.log", false, true},
+		{"other name", []string{"*.log"}, "a.go", false, false},
+		{"star stops at slash", []string{"a*"}, "ab/c", false, false},
+		{"question mark", []string{"a?c"}, "abc", false, true},
+		{"question mark stops at slash", []string{"a?c"}, "a/c", false, false},
+
+		{"anchored at the root", []string{"/top.txt"}, "top.txt", false, true},
+		{"anchored not nested", []string{"/top.txt"}, "b/top.txt", false, false},
+		{"slash in the middle anchors", []string{"a/b"}, "x/a/b", false, false},
+
+		{"dir only matches a directory", []string{"build/"}, "build", true, true},
+		{"dir only at any level", []string{"build/"}, "x/build", true, true},
+		{"dir only skips a file", []string{"build/"}, "build", false, false},
+
+		{"leading double star", []string{"**/foo"}, "foo", false, true},
+		{"leading double star nested", []string{"**/foo"}, "a/b/foo", false, true},
+		{"middle double star none", []string{"a/**/b"}, "a/b", false, true},
+		{"middle double star several", []string{"a/**/b"}, "a/x/y/b", false, true},
+		{"middle double star anchored", []string{"a/**/b"}, "c/a/b", false, false},
+		{"trailing double star", []string{"abc/**"}, "abc/x/y", false, true},
+		{"trailing double star not the dir", []string{"abc/**"}, "abc", true, false},
+
+		{"negation", []string{"*.md", "!keep.md"}, "keep.md", false, false},
+		{"negation of another name", []string{"*.md", "!keep.md"}, "skip.md", false, true},
+		{"last rule decides", []string{"!keep.md", "*.md"}, "keep.md", false, true},
+		{"negation in a nested file", []string{"*.md", "d:!keep.md"}, "d/keep.md", false, false},
+
+		{"class", []string{"[abc].txt"}, "b.txt", false, true},
+		{"class other", []string{"[abc].txt"}, "d.txt", false, false},
+		{"class range", []string{"[a-c]x"}, "bx", false, true},
+		{"negated class", []string{"[!a].txt"}, "b.txt", false, true},
+		{"negated class excluded", []string{"[!a].txt"}, "a.txt", false, false},
+		{"unclosed class is literal", []string{"[a"}, "[a", false, true},
+
+		{"nested file", []string{"d:*.md"}, "d/x.md", false, true},
+		{"nested file outside its dir", []string{"d:*.md"}, "x.md", false, false},
+		{"nested anchored", []string{"d:/x"}, "d/x", false, true},
+		{"nested anchored deeper", []string{"d:/x"}, "d/e/x", false, false},
+
+		{"comment", []string{"#x"}, "#x", false, false},
+		{"escaped hash", []string{`\#x`}, "#x", false, true},
+		{"escaped bang", []string{`\!x`}, "!x", false, true},
+		{"trailing spaces", []string{"a.txt  "}, "a.txt", false, true},
+		{"dot is literal", []string{"a.txt"}, "abtxt", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ig := &ignore{}
+			for _, line := range tt.lines {
+				base := ""
+				if i := indexBase(line); i >= 0 {
+					base, line = line[:i], line[i+1:]
+				}
+				if r, ok := parseRule(line, base); ok {
+					ig.rules = append(ig.rules, r)
+				}
+			}
+			if got := ig.ignored(tt.rel, tt.isDir); got != tt.want {
+				t.Errorf("%q ignored(%q, %v) = %v, want %v", tt.lines, tt.rel, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+// Index of the colon after the base directory of a test line, -1 for the root
+func indexBase(line string) int {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ':':
+			return i
+		case '*', '!', '/', '\\', '[', '#':
+			return -1
+		}
+	}
+	return -1
+}
+
+func TestParseRuleSkipped(t *testing.T) {
+	for _, line := range []string{"", "   ", "# comment", "/", "!"} {
+		if _, ok := parseRule(line, ""); ok {
+			t.Errorf("parseRule(%q) is a rule", line)
+		}
+	}
+}
+
+func TestIgnoredPath(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		".gitignore":       "*.log\nbuild/\n",
+		"src/.gitignore":   "gen.go\n!keep.log\n",
+		"src/a.go":         "",
+		"build/out.go":     "",
+		".git/config":      "",
+		"src/sub/gen.go":   "",
+		"src/sub/keep.log": "",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"src/a.go", false},
+		{"src/new.go", false}, // Not on disk
+		{"a.log", true},
+		{"build/out.go", true},
+		{"build/new/b.go", true},
+		{".git/config", true},
+		{"src/gen.go", true},
+		{"src/sub/gen.go", true},
+		{"src/sub/keep.log", false},
+		{"other/keep.log", true},
+	}
+	for _, tt := range tests {
+		if got := Ignored(root, filepath.Join(root, filepath.FromSlash(tt.rel))); got != tt.want {
+			t.Errorf("Ignored(%q) = %v, want %v", tt.rel, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Package grep searches the files under a directory concurrently
+// Files ignored by .gitignore, the .git directory and binary files are skipped
+// Files are decoded and split into lines as the editor loads them, so results are at the rows and columns of the buffer
+package grep
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/ge-editor/editorview/file"
+)
+
+// Matcher returns the start and stop byte offsets of the matches in a line without its linefeed
+type Matcher func(line []byte) [][]int
+
+// Result is a line with one or more matches
+type Result struct {
+	Path     string  // Path of the file under the root given to Search
+	RowIndex int     // 0-based index of the line
+	Line     []byte  // Decoded to UTF-8, without the linefeed
+	Matches  [][]int // Start and stop byte offsets in Line
+}
+
+// Number of files searched at once
+var Workers = runtime.NumCPU()
+
+// A file with a NUL byte in its first binaryCheckSize bytes is binary, as git decides
+const binaryCheckSize = 8000
+
+// Search searches the files under root with match and calls found with the results of each file
+// found is called for one file at a time, files in no particular order
+// Returns ctx.Err() if ctx is done before all files are searched
+func Search(ctx context.Context, root string, match Matcher, found func(results []Result)) error {
+	paths := make(chan string)
+	var walkErr error
+	go func() {
+		defer close(paths)
+		walkErr = walk(ctx, root, func(path string) bool {
+			select {
+			case paths <- path:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for range max(Workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				results := searchFile(ctx, path, match) // An unreadable file has no results
+				if len(results) == 0 {
+					continue
+				}
+				mutex.Lock()
+				found(results)
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if walkErr != nil {
+		return walkErr
+	}
+	return ctx.Err()
+}
+
+// Walk the regular files under root that are not ignored, until visit returns false
+func walk(ctx context.Context, root string, visit func(path string) bool) error {
+	ig := &ignore{}
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil // Skip what cannot be read
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if path == root {
+				rel = ""
+			} else if d.Name() == ".git" || ig.ignored(rel, true) {
+				return fs.SkipDir
+			}
+			ig.read(path, rel) // A broken .gitignore ignores nothing
+			return nil
+		}
+		if !d.Type().IsRegular() || ig.ignored(rel, false) {
+			return nil
+		}
+		if !visit(path) {
+			return ctx.Err()
+		}
+		return nil
+	})
+}
+
+// Search the lines of the file at path, a binary file has no results
+// The file is decoded and split into lines as the editor loads it, the results are at its rows and columns
+func searchFile(ctx context.Context, path string, match Matcher) []Result {
+	data, err := file.ReadDecoded(path)
+	if err != nil || bytes.IndexByte(data[:min(len(data), binaryCheckSize)], 0) >= 0 {
+		return nil
+	}
+	var results []Result
+	for rowIndex, line := range file.SplitLines(data) {
+		if rowIndex%1024 == 0 && ctx.Err() != nil {
+			return nil
+		}
+		if matches := match(line); len(matches) > 0 {
+			// The line is cloned not to keep the whole file in memory
+			results = append(results, Result{Path: path, RowIndex: rowIndex, Line: slices.Clone(line), Matches: matches})
+		}
+	}
+	return results
+}
@@ -0,0 +1,62 @@
+package grep
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestSearchFileDecodes(t *testing.T) {
+	sjis, _ := japanese.ShiftJIS.NewEncoder().Bytes([]byte("日本語\nの検索\n"))
+	utf16, _ := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().Bytes([]byte("a\r\nの検索\r\n"))
+	tests := []struct {
+		name string
+		data []byte
+		row  int
+		col  int
+	}{
+		{"LF", []byte("a\nの検索\n"), 1, 3},
+		{"CRLF", []byte("a\r\nの検索\r\n"), 1, 3},
+		{"CR", []byte("a\rの検索\r"), 1, 3},
+		{"Shift_JIS", sjis, 1, 3},
+		{"UTF-16LE", utf16, 1, 3},
+	}
+	match := func(line []byte) [][]int {
+		if i := bytes.Index(line, []byte("検索")); i >= 0 {
+			return [][]int{{i, i + len("検索")}}
+		}
+		return nil
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "a.txt")
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			results := searchFile(context.Background(), path, match)
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1", len(results))
+			}
+			r := results[0]
+			if r.RowIndex != tt.row || r.Matches[0][0] != tt.col || string(r.Line) != "の検索" {
+				t.Errorf("got row %d col %d line %q, want row %d col %d", r.RowIndex, r.Matches[0][0], r.Line, tt.row, tt.col)
+			}
+		})
+	}
+}
+
+func TestSearchFileBinary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.bin")
+	if err := os.WriteFile(path, []byte("検索\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	match := func(line []byte) [][]int { return [][]int{{0, 1}} }
+	if results := searchFile(context.Background(), path, match); results != nil {
+		t.Errorf("got %d results in a binary file", len(results))
+	}
+}
@@ -0,0 +1,63 @@
+package mark
+
+// Number of positions kept in the jump list, older ones are removed
+const JumpListSize = 100
+
+func NewJumpList() *jumpList {
+	return &jumpList{}
+}
+
+// Positions before jumps in all files, the oldest first
+type jumpList struct {
+	entries []*Mark
+	index   int // Entry of the last Back or Forward, len(entries) if not going back
+}
+
+// Push the position before a jump
+// An entry on the same row of the same file is removed, going back starts from the newest entry again
+func (j *jumpList) Push(a *Mark) {
+	j.remove(a)
+	j.entries = append(j.entries, a)
+	if len(j.entries) > JumpListSize {
+		j.entries = j.entries[1:]
+	}
+	j.index = len(j.entries)
+}
+
+// Back returns the entry before the current one, nil if there is none
+// current is pushed when going back from the newest entry, so Forward can return to it
+func (j *jumpList) Back(current *Mark) *Mark {
+	if j.index == len(j.entries) {
+		j.Push(current)
+		j.index = len(j.entries) - 1
+	}
+	if j.index == 0 {
+		return nil
+	}
+	j.index--
+	return j.entries[j.index]
+}
+
+// Forward returns the entry after the current one, nil if there is none
+func (j *jumpList) Forward() *Mark {
+	if j.index >= len(j.entries)-1 {
+		return nil
+	}
+	j.index++
+	return j.entries[j.index]
+}
+
+// Entries, the oldest first
+func (j *jumpList) Marks() []*Mark {
+	return j.entries
+}
+
+// Remove the entry on the same row of the same file as a
+func (j *jumpList) remove(a *Mark) {
+	for i, b := range j.entries {
+		if b.FilePath == a.FilePath && b.RowIndex == a.RowIndex {
+			j.entries = append(j.entries[:i], j.entries[i+1:]...)
+			return
+		}
+	}
+}
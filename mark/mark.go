@@ -24,12 +24,21 @@ type Mark struct {
 	Content string
 }
 
+// Number of marks kept for each file, older marks are removed
+const RingSize = 16
+
+// Marks of all files, the oldest first
+// The marks of a file are its mark ring
 type marks []*Mark
 
 // SetMark mark if exists unset and append
+// The oldest mark of the file is removed when it has more than RingSize marks
 func (m *marks) SetMark(a *Mark) {
 	m.UnsetMark(a)
 	*m = append(*m, a)
+	if ring := m.FilterByPath(a.FilePath); len(ring) > RingSize {
+		m.UnsetMark(ring[0])
+	}
 }
 
 func (m *marks) UnsetMark(d *Mark) bool {
@@ -53,6 +62,31 @@ func (m *marks) FindLastByPath(filePath string) *Mark {
 	return nil
 }
 
+// Marks of filePath, the oldest first
+func (m *marks) FilterByPath(filePath string) []*Mark {
+	ring := []*Mark{}
+	for _, a := range *m {
+		if utils.SameFile(a.FilePath, filePath) {
+			ring = append(ring, a)
+		}
+	}
+	return ring
+}
+
+// Move d to the oldest position
+func (m *marks) MoveToFront(d *Mark) {
+	if m.UnsetMark(d) {
+		*m = append([]*Mark{d}, *m...)
+	}
+}
+
+// Move d to the newest position
+func (m *marks) MoveToBack(d *Mark) {
+	if m.UnsetMark(d) {
+		*m = append(*m, d)
+	}
+}
+
 func (m *marks) Prev(d *Mark) *Mark {
 	i := m.index(d)
 	if i <= 0 {
@@ -0,0 +1,38 @@
+package mark
+
+import (
+	"errors"
+	"slices"
+)
+
+var ErrRegisterName = errors.New("register name must be a to z")
+
+func NewRegisters() registers {
+	return registers{}
+}
+
+// Positions stored under the names a to z
+type registers map[rune]*Mark
+
+func (r registers) Set(name rune, a *Mark) error {
+	if name < 'a' || name > 'z' {
+		return ErrRegisterName
+	}
+	r[name] = a
+	return nil
+}
+
+// Return nil if not set
+func (r registers) Get(name rune) *Mark {
+	return r[name]
+}
+
+// Names of the set registers in alphabetical order
+func (r registers) Names() []rune {
+	names := make([]rune, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
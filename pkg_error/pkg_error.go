@@ -9,9 +9,11 @@ var (
 	// Buffer messages
 	ErrorNewFile    = errors.New("(New file)")
 	ErrorLoadedFile = errors.New("(Loaded)")
+	ErrorRecovery   = errors.New("(Recovery file found)")
 
 	// Encoded messages
 	ErrMac      = errors.New("Normalized from UTF-8-mac to UTF-8")
 	ErrShiftJis = errors.New("Encoded from ShiftJIS to UTF-8")
 	ErrEucJp    = errors.New("Encoded from EUC-JP to UTF-8")
+	ErrUtf16    = errors.New("Encoded from UTF-16 to UTF-8")
 )
@@ -3,28 +3,38 @@ package editorview
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"path/filepath"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode"
 	"unicode/utf8"
 
-	"github.com/atotto/clipboard"
+	"github.com/gdamore/tcell/v2"
 
 	"github.com/ge-editor/gecore"
 	"github.com/ge-editor/gecore/define"
 	"github.com/ge-editor/gecore/kill_buffer"
 	"github.com/ge-editor/gecore/screen"
+	"github.com/ge-editor/gecore/tree"
 	"github.com/ge-editor/gecore/verb"
 
 	"github.com/ge-editor/utils"
 
 	"github.com/ge-editor/theme"
 
+	"github.com/ge-editor/editorview/buffer"
+	"github.com/ge-editor/editorview/clipboard"
+	"github.com/ge-editor/editorview/diff"
 	"github.com/ge-editor/editorview/file"
+	"github.com/ge-editor/editorview/grep"
 	"github.com/ge-editor/editorview/mark"
+	"github.com/ge-editor/editorview/pkg_error"
 )
 
 // ------------------------------------------------------------------
@@ -32,11 +42,20 @@ import (
 // ------------------------------------------------------------------
 
 // If the file has already been read, use that buffer
+// The position before opening is recorded in the jump list
 func (e *Editor) OpenFile(path string) error {
-	ff, meta, err := BufferSets.GetFileAndMeta(path)
+	e.recordJump()
+	return e.openFile(path)
+}
+
+func (e *Editor) openFile(path string) error {
+	ff, meta, notices, err := BufferSets.OpenFileAndMeta(path)
 	e.File = ff
 	e.Meta = meta
 	e.bsArray.ClearAll()
+	for _, notice := range notices {
+		e.screen.Echo(notice.Error())
+	}
 	return err // return message
 }
 
@@ -60,8 +79,34 @@ func (e *Editor) adjustFormattedCursorPosition() {
 	e.ColIndex = i
 }
 
-// If the file does not exist, a backup error will occur
+// The file on disk is backed up by the backup policy, see file.SetBackupPolicy
+// The file is not overwritten if it was modified on disk since it was loaded, see ForceSaveFile
 func (e *Editor) SaveFile() {
+	e.saveFile(false)
+}
+
+// Save the file even if it was modified on disk since it was loaded
+func (e *Editor) ForceSaveFile() {
+	e.saveFile(true)
+}
+
+func (e *Editor) saveFile(force bool) {
+	message, _ := e.saveBuffer(force)
+	e.screen.Echo(message)
+}
+
+// Save the buffer and return the message about it, ok is false if it was not saved
+func (e *Editor) saveBuffer(force bool) (message string, ok bool) {
+	if e.IsScratch() {
+		return e.GetDispPath() + " is not a file", false
+	}
+	if e.IsReadonly() {
+		return e.GetDispPath() + " is readonly", false
+	}
+	if !force && e.IsModifiedOnDisk() {
+		return e.GetDispPath() + " changed on disk, not saved (ReloadFile, DiffWithDisk, KeepBuffer or ForceSaveFile)", false
+	}
+
 	backupMessage := ""
 	if err := e.Backup(); err != nil {
 		backupMessage = " (" + err.Error() + ")"
@@ -78,7 +123,7 @@ func (e *Editor) SaveFile() {
 		if e.RowIndex >= rowLength {
 			e.RowIndex = rowLength - 1
 		}
-		line := (*e.Rows())[e.RowIndex]
+		line := e.Rows().Row(e.RowIndex).Bytes()
 		colLength := len(line)
 		if e.ColIndex >= colLength {
 			// cursor on linefeed or EOF
@@ -87,13 +132,177 @@ func (e *Editor) SaveFile() {
 		for !utf8.RuneStart(line[e.ColIndex]) && e.ColIndex > 0 {
 			e.ColIndex--
 		}
-		e.screen.Echo("Wrote " + e.GetPath() + backupMessage)
-	} else {
-		e.screen.Echo(err.Error() + backupMessage)
+		// e.UndoAction.MoveTo(e.RedoAction)
+		e.UndoAction.MarkSaved()
+		if err := e.SaveUndo(); err != nil {
+			verb.PP("save undo %s", err.Error())
+		}
+		return "Wrote " + e.GetPath() + backupMessage, true
+	}
+	return err.Error() + backupMessage, false
+}
+
+// ------------------------------------------------------------------
+// File modified on disk
+// ------------------------------------------------------------------
+
+// Tell the user if the file was modified on disk since it was loaded or saved
+// Called when the view gets focus, may also be called periodically
+func (e *Editor) CheckModifiedOnDisk() bool {
+	if !e.IsModifiedOnDisk() {
+		return false
 	}
+	e.screen.Echo(e.GetDispPath() + " changed on disk (ReloadFile, DiffWithDisk or KeepBuffer)")
+	return true
+}
 
-	// e.UndoAction.MoveTo(e.RedoAction)
+// Replace the buffer with the file on disk
+// Undo restores the content of the buffer before reloading
+func (e *Editor) ReloadFile() {
+	if e.IsScratch() {
+		return
+	}
+	if !e.replaceContent(e.Load) {
+		return
+	}
 	e.UndoAction.MarkSaved()
+	e.screen.Echo("Reloaded " + e.GetPath())
+}
+
+// Keep the buffer and ignore the modification on disk, the next save overwrites the file
+func (e *Editor) KeepBuffer() {
+	e.KeepModifiedOnDisk()
+	e.UndoAction.MarkUnsaved() // The buffer differs from the file on disk
+	e.screen.Echo("Keep buffer, " + e.GetDispPath() + " is overwritten on save")
+}
+
+// Show the differences between the file on disk and the buffer in a scratch buffer
+func (e *Editor) DiffWithDisk() {
+	if e.IsScratch() {
+		return
+	}
+	disk, err := e.ReadFromDisk()
+	if err != nil {
+		e.screen.Echo(err.Error())
+		return
+	}
+	hunks := diff.Lines(diffLines(disk), diffLines(e.contentBytes()), 3)
+	if len(hunks) == 0 {
+		e.screen.Echo("No differences with " + e.GetDispPath())
+		return
+	}
+	content := diff.Unified(e.GetPath()+" (disk)", e.GetPath()+" (buffer)", hunks)
+	e.File, e.Meta = BufferSets.GetScratchFileAndMeta("*diff* "+e.GetBase(), []byte(content))
+	e.bsArray.ClearAll()
+	e.specialCharWidths = nil
+}
+
+// Split data into lines for diff, linefeeds are not compared
+func diffLines(data []byte) []string {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\r"), []byte("\n"))
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	if len(data) == 0 {
+		return []string{}
+	}
+	return strings.Split(string(data), "\n")
+}
+
+// ------------------------------------------------------------------
+// Crash recovery
+// ------------------------------------------------------------------
+
+// Tell the user if a crash-recovery file newer than the file exists
+func (e *Editor) CheckRecovery() bool {
+	if !e.HasRecovery() {
+		return false
+	}
+	e.screen.Echo("Recovery file of " + e.GetDispPath() + " is newer (RecoverFile or DiscardRecovery)")
+	return true
+}
+
+// Replace the buffer with the crash-recovery file
+// Undo restores the content of the buffer before recovering
+func (e *Editor) RecoverFile() {
+	if !e.HasRecovery() {
+		e.screen.Echo("No recovery file of " + e.GetDispPath())
+		return
+	}
+	recovered := e.replaceContent(func() error {
+		data, lf, terminators, err := e.ReadRecovery()
+		if err != nil {
+			return err
+		}
+		e.SetContent(data)
+		return e.SetRowLinefeeds(lf, terminators)
+	})
+	if !recovered {
+		return
+	}
+	e.UndoAction.MarkUnsaved()
+	e.WriteRecovery() // Kept by this session from now on
+	e.screen.Echo("Recovered " + e.GetDispPath() + ", save to keep it")
+}
+
+// Remove the crash-recovery file without restoring it
+func (e *Editor) DiscardRecovery() {
+	if err := e.RemoveRecovery(); err != nil {
+		e.screen.Echo(err.Error())
+		return
+	}
+	e.screen.Echo("Discarded recovery file of " + e.GetDispPath())
+}
+
+// Write crash-recovery files of dirty buffers every AutosaveInterval
+// The content is taken on the event loop and written in the background
+func autosave() {
+	if AutosaveInterval <= 0 || time.Since(lastAutosave) < AutosaveInterval {
+		return
+	}
+	lastAutosave = time.Now()
+	if write := BufferSets.Autosave(); write != nil {
+		go func() {
+			if err := write(); err != nil {
+				verb.PP("autosave %s", err.Error())
+			}
+		}()
+	}
+}
+
+// Replace the buffer with the content read by load as one undo group
+// Undo restores the previous content, encoding and linefeeds at once.
+func (e *Editor) replaceContent(load func() error) bool {
+	start := file.Cursor{RowIndex: 0, ColIndex: 0}
+	fromCharset, fromLinefeed, fromTerminators := e.GetEncoding(), e.GetDefaultLinefeed(), e.GetRowLinefeeds()
+	before := e.contentBytes()
+	beforeEnd := file.EndCursor(start, before)
+	beforeTerminators := e.GetTerminators(start, beforeEnd)
+
+	if err := load(); err != nil {
+		e.screen.Echo(err.Error())
+		return false
+	}
+	after := e.contentBytes()
+	afterEnd := file.EndCursor(start, after)
+	toTerminators := e.GetRowLinefeeds()
+
+	e.bsArray.ClearAll()
+	e.specialCharWidths = nil
+	e.syncCursorAndBufferForEdit(DELETE, start, beforeEnd)
+	e.syncCursorAndBufferForEdit(INSERT, start, afterEnd)
+	e.Cursor = start
+	e.PrevCx = 0
+
+	// Undo runs in reverse order, so attributes are restored after the previous content
+	// The content actions keep the terminators of their rows, inserting text resets them
+	group := &file.EditGroup{Actions: []*file.EditAction{
+		{Class: file.LINEFEED, Before: start, After: start, From: fromLinefeed, To: e.GetDefaultLinefeed(), FromTerminators: fromTerminators, ToTerminators: toTerminators},
+		{Class: file.CHARSET, Before: start, After: start, From: fromCharset, To: e.GetEncoding()},
+		{Class: file.DELETE, Before: start, After: start, Data: before, FromTerminators: beforeTerminators},
+		{Class: file.INSERT, Before: start, After: afterEnd, Data: after, ToTerminators: e.GetTerminators(start, afterEnd)},
+	}}
+	e.UndoAction.PushGroup(group)
+	return true
 }
 
 // If an existing file is specified, it will be overwritten
@@ -103,137 +312,94 @@ func (e *Editor) ChangeFilePath(path string) {
 }
 
 // ------------------------------------------------------------------
-// Move cursor
+// Encoding and linefeed
 // ------------------------------------------------------------------
 
-// Move cursor to next word.
-func (e *Editor) MoveCursorNextWord() {
-	verb.PP("MoveCursorNextWord")
-	x, y := e.Cx, e.Cy
+// Convert the linefeed written on save to "LF", "CRLF" or "CR"
+func (e *Editor) ChangeLinefeed(linefeed string) {
+	from := e.GetLinefeed()
+	if from == linefeed {
+		e.screen.Echo("Linefeed is already " + linefeed)
+		return
+	}
+	fromDefault, terminators := e.GetDefaultLinefeed(), e.GetRowLinefeeds() // Mixed linefeeds are normalized
+	if err := e.SetLinefeed(linefeed); err != nil {
+		e.screen.Echo(err.Error())
+		return
+	}
+	e.UndoAction.PushAction(&file.EditAction{Class: file.LINEFEED, Before: e.Cursor, After: e.Cursor, From: fromDefault, To: linefeed, FromTerminators: terminators})
+	e.screen.Echo("Linefeed " + from + " to " + linefeed)
+}
 
-	lines := e.Rows()
-	// line, _ := lines.GetRow(e.RowIndex)
-	line := lines.Row(e.RowIndex)
-	if line.IsColIndexAtRowEnd(e.ColIndex) {
-		if lines.IsRowIndexLastRow(e.RowIndex) {
-			e.screen.Echo("End of buffer")
+// Re-encode the buffer, the file is written in charset on save
+func (e *Editor) ChangeEncoding(charset string) {
+	from := e.GetEncoding()
+	if from == charset {
+		e.screen.Echo("Encoding is already " + charset)
+		return
+	}
+	// Check that the buffer can be represented in charset before the save fails
+	if encoder := file.GetEncoder(charset); encoder != nil {
+		content := e.contentBytes()
+		if err := encoder.Encoder(&content); err != nil {
+			e.screen.Echo(charset + ": " + err.Error())
 			return
 		}
-		y++
-		e.RowIndex++
-		x = 0
-		e.ColIndex = 0
+	}
+	if err := e.SetEncoding(charset); err != nil {
+		e.screen.Echo(err.Error())
 		return
 	}
+	e.UndoAction.PushAction(&file.EditAction{Class: file.CHARSET, Before: e.Cursor, After: e.Cursor, From: from, To: charset})
+	e.screen.Echo("Encoding " + from + " to " + charset)
+}
 
-	var prevCc, cc screen.CharClass
-	notUppercaseBit := ^screen.UPPERCASE
-	for {
-		ch, size, ok := (*lines).Row(e.RowIndex).DecodeRune(e.ColIndex)
-		if !ok {
-			verb.PP("error")
-			panic("err")
-		}
-		w, ok := e.runeWidth(ch, e.RowIndex, e.ColIndex)
-		if !ok {
-			verb.PP("error")
-		}
-		prevCc = cc
-		cc = screen.GetCharClass(ch)
-		if prevCc != 0 {
-			if prevCc&screen.UPPERCASE == 0 && cc&screen.UPPERCASE > 0 {
-				break
-			}
-			prevCc &= notUppercaseBit
-			cc &= notUppercaseBit
-			if prevCc != cc && cc&screen.TAB == 0 && cc&screen.SPACE == 0 && cc&screen.SYMBOL == 0 {
-				break
-			}
-		}
-		//e.makeAvailableBoundariesArray(e.RowIndex) // -------- !
-		if e.isEndOfLogicalRow(e.RowIndex, e.ColIndex) {
-			y++
-			x = 0
-		} else {
-			x += w
-		}
-		e.ColIndex += size
+// Re-interpret the file on disk as charset and replace the buffer with it.
+// Undo restores the previous content and encoding at once.
+func (e *Editor) ReinterpretEncoding(charset string) {
+	if !e.replaceContent(func() error { return e.LoadWithCharset(charset) }) {
+		return
 	}
+	e.screen.Echo("Reinterpreted as " + e.GetEncoding())
+}
 
-	e.PrevCx = x
-	e.moveCursor(x, y)
+// Return the buffer content without the EOF mark
+func (e *Editor) contentBytes() []byte {
+	content, _, err := e.Bytes()
+	if err != nil || len(content) == 0 {
+		return []byte{}
+	}
+	return content[:len(content)-1]
 }
 
-func (e *Editor) MoveCursorPreviousWord() {
-	x, y := e.Cx, e.Cy
+// ------------------------------------------------------------------
+// Move cursor
+// ------------------------------------------------------------------
 
-	if e.ColIndex == 0 {
-		if e.RowIndex == 0 {
-			e.screen.Echo("Beginning of buffer")
-			return
-		}
-		y--
-		e.RowIndex-- // previous line
-		//e.makeAvailableBoundariesArray(e.RowIndex) // -------- !
-		//bs := e.bsay.Boundaries(e.RowIndex)
-		//lastBs := bs.LastBoundary()
-		lastBs := e.bsArray.LastBoundary(e.RowIndex)
-		// lastBs := e.bsay[e.RowIndex].boundaries[e.bsay[e.RowIndex].Len()-1]
-		ch, _, colIndex, _ := e.Rows().Row(e.RowIndex).DecodeEndRune()
-		w, _ := e.runeWidth(ch, e.RowIndex, colIndex)
-		x = lastBs.Width - w  // on linefeed
-		e.ColIndex = colIndex // lastBs.stopIndex - size
-	} else {
-		var prevCc, cc screen.CharClass
-		notUppercaseBit := ^screen.UPPERCASE
-		for {
-			//e.makeAvailableBoundariesArray(e.RowIndex) // -------- !
-			before, ok := e.getIndexOfLogicalRow(e.RowIndex, e.ColIndex)
-			if !ok {
-				panic("1")
-			}
-			ch, _, colIndex, ok := e.Rows().Row(e.RowIndex).DecodePrevRune(e.ColIndex)
-			if !ok {
-				// panic("2")
-				break
-			}
-			w, ok := e.runeWidth(ch, e.RowIndex, e.ColIndex)
-			if !ok {
-				verb.PP("error")
-			}
-			prevCc = cc
-			cc = screen.GetCharClass(ch)
-			if prevCc != 0 {
-				savePrevCC, saveCC := prevCc, cc
-				prevCc &= notUppercaseBit
-				cc &= notUppercaseBit
-				if prevCc != cc && (cc&screen.TAB > 0 || cc&screen.SPACE > 0 || cc&screen.SYMBOL > 0) {
-					break
-				}
-				prevCc, cc = savePrevCC, saveCC
-			}
-			e.ColIndex = colIndex
-			after, ok := e.getIndexOfLogicalRow(e.RowIndex, e.ColIndex)
-			if !ok {
-				panic("3")
-			}
-			if after < before {
-				y--
-				//bs := e.bsay.Boundaries(e.RowIndex)
-				//x = bs[after].Width - w
-				x = e.bsArray.Boundary(e.RowIndex, after).Width
-				// x = e.bsay[e.RowIndex].boundaries[after].Width - w
-			} else {
-				x -= w
-			}
-			if prevCc != 0 && prevCc&screen.UPPERCASE == 0 && cc&screen.UPPERCASE > 0 {
-				break
-			}
-		}
+// Move cursor to next word.
+// Secondary cursors move too
+func (e *Editor) MoveCursorNextWord() {
+	verb.PP("MoveCursorNextWord")
+	e.moveSecondaryCursors(e.nextWordCursor)
+	defer e.uniqueCursors()
+
+	if e.Rows().IsRowIndexLastRow(e.RowIndex) && e.Rows().Row(e.RowIndex).IsColIndexAtRowEnd(e.ColIndex) {
+		e.screen.Echo("End of buffer")
+		return
 	}
+	e.moveCursorTo(e.nextWordCursor(e.Cursor))
+}
 
-	e.PrevCx = x
-	e.moveCursor(x, y)
+// Secondary cursors move too
+func (e *Editor) MoveCursorPreviousWord() {
+	e.moveSecondaryCursors(e.prevWordCursor)
+	defer e.uniqueCursors()
+
+	if e.RowIndex == 0 && e.ColIndex == 0 {
+		e.screen.Echo("Beginning of buffer")
+		return
+	}
+	e.moveCursorTo(e.prevWordCursor(e.Cursor))
 }
 
 // Move cursor one character forward.
@@ -534,6 +700,7 @@ func (e *Editor) MoveCursorBeginningOfLogicalLine() {
 }
 
 func (e *Editor) MoveCursorBeginningOfFile() {
+	e.recordJump()
 	e.RowIndex = 0
 	e.ColIndex = 0
 	e.Cy = 0
@@ -542,6 +709,7 @@ func (e *Editor) MoveCursorBeginningOfFile() {
 }
 
 func (e *Editor) MoveCursorEndOfFile() {
+	e.recordJump()
 	// e.RowIndex = e.Rows().RowLength() - 1
 	e.RowIndex = e.Rows().Length() - 1
 	// e.drawLine(0, e.RowIndex, 0, false)
@@ -645,6 +813,7 @@ func (e *Editor) MoveCursorToLine(lineNumber int) {
 	if lineNumber < 1 || lineNumber > e.Rows().Length() {
 		return
 	}
+	e.recordJump()
 	e.RowIndex = lineNumber - 1
 	e.ColIndex = 0
 	// e.Cy = (e.Height - 1) / 2
@@ -654,10 +823,8 @@ func (e *Editor) MoveCursorToLine(lineNumber int) {
 func (e *Editor) InsertTab() {
 	if (*e.GetLangMode()).GetSoftTab() {
 		w := utils.TabWidth(e.Cx, e.GetTabWidth())
-		for i := 0; i < w; i++ {
-			// e.InsertRune__(' ')
-			e.insertBytes([]byte{' '}, true)
-		}
+		// e.InsertRune__(' ')
+		e.insertBytes(bytes.Repeat([]byte{' '}, w), true)
 	} else {
 		// e.InsertRune__('\t')
 		e.insertBytes([]byte{'\t'}, true)
@@ -674,11 +841,17 @@ func (e *Editor) InsertString(s string) {
 }
 
 // Wrapper is insertBytes
+// Inserted at every cursor
 func (e *Editor) InsertRune(ch rune) {
-	e.insertBytes(utils.RuneToBytes(ch), true)
+	e.forEachCursor(func() { e.insertBytes(utils.RuneToBytes(ch), true) })
 }
 
+// Deleted at every cursor
 func (e *Editor) DeleteRuneBackward() {
+	e.forEachCursor(e.deleteRuneBackward)
+}
+
+func (e *Editor) deleteRuneBackward() {
 	start := e.Cursor
 	stop := e.Cursor
 	_, _, colIndex, _ := e.Rows().Row(e.RowIndex).DecodePrevRune(e.ColIndex)
@@ -691,10 +864,11 @@ func (e *Editor) DeleteRuneBackward() {
 		// join to prev row
 		lines := e.Rows()
 		start.RowIndex--
-		start.ColIndex = len((*lines)[start.RowIndex]) - 1
+		start.ColIndex = lines.Row(start.RowIndex).Length() - 1
 	} else {
 		start.ColIndex = colIndex
 	}
+	terminators := e.GetTerminators(start, stop)
 	removed := e.RemoveRegion(start, stop)
 	if removed == nil {
 		return
@@ -707,7 +881,7 @@ func (e *Editor) DeleteRuneBackward() {
 		e.bsArray.Delete(start.RowIndex+1, count)
 	}
 
-	e.UndoAction.PushAction(&file.EditAction{Class: file.DELETE_BACKWARD, Before: stop, After: start, Data: *removed})
+	e.UndoAction.PushAction(&file.EditAction{Class: file.DELETE_BACKWARD, Before: stop, After: start, Data: *removed, FromTerminators: terminators})
 	e.syncCursorAndBufferForEdit(DELETE, start, stop)
 
 	e.PrevCx = -1
@@ -727,6 +901,7 @@ func (e *Editor) DeleteRune() {
 	} else {
 		stop.ColIndex += size
 	}
+	terminators := e.GetTerminators(start, stop)
 	removed := e.RemoveRegion(start, stop)
 	if removed == nil {
 		return
@@ -738,15 +913,17 @@ func (e *Editor) DeleteRune() {
 		e.bsArray.Delete(start.RowIndex+1, count)
 	}
 
-	e.UndoAction.PushAction(&file.EditAction{Class: file.DELETE, Before: start, After: start, Data: *removed})
+	e.UndoAction.PushAction(&file.EditAction{Class: file.DELETE, Before: start, After: start, Data: *removed, FromTerminators: terminators})
 	e.syncCursorAndBufferForEdit(DELETE, stop, start)
 
 	e.PrevCx = -1
 }
 
 func (e *Editor) Autoindent() {
+	defer e.undoGroup()()
+
 	lines := e.Rows()
-	line := (*lines)[e.RowIndex]
+	line := lines.Row(e.RowIndex).Bytes()
 	indent := make([]byte, 0, len(line))
 	indent = append(indent, '\n')
 	for i := 0; i < len(line); {
@@ -762,93 +939,495 @@ func (e *Editor) Autoindent() {
 }
 
 // ------------------------------------------------------------------
-// Mark
+// Multiple cursors
 // ------------------------------------------------------------------
 
-func (e *Editor) SetMark() {
-	content := e.getContentWidthoutSpecialCharactor(e.Cursor, 20)
-
-	newMark := mark.NewMark(e.GetPath(), e.Cursor, content)
+// Add a cursor where the cursor is and move the cursor to the next line
+func (e *Editor) AddCursorNextLine() {
+	c := e.Cursor
+	e.MoveCursorNextLine()
+	if !e.Cursor.Equals(c) {
+		e.addCursor(c)
+	}
+}
 
-	if Marks.UnsetMark(newMark) {
-		e.screen.Echo("Unset mark")
-		return
+// Add a cursor where the cursor is and move the cursor to the previous line
+func (e *Editor) AddCursorPrevLine() {
+	c := e.Cursor
+	e.MoveCursorPrevLine()
+	if !e.Cursor.Equals(c) {
+		e.addCursor(c)
 	}
-	Marks.SetMark(newMark)
-	e.screen.Echo("Set mark")
 }
 
-func (e *Editor) SwapCursorAndMark() {
-	m := Marks.FindLastByPath(e.GetPath())
-	if m == nil {
-		e.screen.Echo("The mark is not set now, so there is no region")
+// Add a cursor where the cursor is and move the cursor to the next search result
+func (e *Editor) AddCursorNextMatch() {
+	if len(e.foundIndexes) == 0 {
+		e.screen.Echo("No search results")
 		return
 	}
-
-	Marks.UnsetMark(m)
-	Marks.SetMark(mark.NewMark(e.GetPath(), e.Cursor, e.getContentWidthoutSpecialCharactor(e.Cursor, 20)))
-	e.Cursor = m.Cursor
+	c := e.Cursor
+	e.MoveNextFoundWord()
+	if !e.Cursor.Equals(c) {
+		e.addCursor(c)
+	}
 }
 
-// ------------------------------------------------------------------
-// Region
-// ------------------------------------------------------------------
-
-// Copy cursor region to Kill Buffer and Clipboard
-func (e *Editor) CopyRegion() {
+// Put a cursor on every line of the region, at the column of the cursor
+func (e *Editor) SplitRegionIntoCursors() {
 	mark := Marks.FindLastByPath(e.GetPath())
 	if mark == nil {
 		e.screen.Echo("The mark is not set now, so there is no region")
 		return
 	}
-	if mark.RowIndex == e.RowIndex && mark.ColIndex == e.ColIndex {
-		e.screen.Echo("Mark and cursor position are the same, so there is no region")
-		return
+	first, last := min(mark.RowIndex, e.RowIndex), max(mark.RowIndex, e.RowIndex)
+	for rowIndex := first; rowIndex <= last && rowIndex < e.Rows().Length(); rowIndex++ {
+		if rowIndex != e.RowIndex {
+			e.addCursor(file.Cursor{RowIndex: rowIndex, ColIndex: e.clampColIndex(rowIndex, e.ColIndex)})
+		}
 	}
+	e.screen.Echo(fmt.Sprintf("%d cursors", len(e.Cursors)+1))
+}
 
-	var err error
-	if mark.RowIndex == e.RowIndex {
-		if mark.ColIndex > e.ColIndex {
-			err = e.copyRegion(e.Cursor, mark.Cursor)
-		} else {
-			err = e.copyRegion(mark.Cursor, e.Cursor)
+// Remove the secondary cursors
+func (e *Editor) ClearCursors() {
+	e.Cursors = nil
+}
+
+func (e *Editor) addCursor(c file.Cursor) {
+	e.Cursors = append(e.Cursors, c)
+	e.uniqueCursors()
+	e.screen.Echo(fmt.Sprintf("%d cursors", len(e.Cursors)+1))
+}
+
+// Remove secondary cursors on the same position as another cursor
+func (e *Editor) uniqueCursors() {
+	slices.SortFunc(e.Cursors, func(a, b file.Cursor) int {
+		if a.RowIndex != b.RowIndex {
+			return a.RowIndex - b.RowIndex
 		}
-	} else if mark.RowIndex > e.RowIndex {
-		err = e.copyRegion(e.Cursor, mark.Cursor)
-	} else {
-		err = e.copyRegion(mark.Cursor, e.Cursor)
-	}
-	if err != nil {
-		e.screen.Echo("Copied, " + err.Error())
-	} else {
-		e.screen.Echo("Copied")
-	}
+		return a.ColIndex - b.ColIndex
+	})
+	e.Cursors = slices.Compact(e.Cursors)
+	e.Cursors = slices.DeleteFunc(e.Cursors, e.Cursor.Equals)
 }
 
-// Delete start to stop bytes and push the bytes to undo-stack and kill-buffer
-// 開始から終了までのバイトを削除し、そのバイトを undo スタックと kill バッファにプッシュする
-func (e *Editor) killRegion(start, stop file.Cursor) {
-	e.Cursor = start
-	removed := e.RemoveRegion(start, stop)
-	if removed == nil {
+// Run command at the cursor and then at every secondary cursor as one undo group
+// Every cursor follows the edits made at the others
+func (e *Editor) forEachCursor(command func()) {
+	if len(e.Cursors) == 0 {
+		command()
 		return
 	}
+	defer e.undoGroup()()
+
+	command()
+	cx, cy, prevCx := e.Cx, e.Cy, e.PrevCx
+	primary := e.Cursor
+	edited := primary
+	for i := range e.Cursors {
+		// The cursor takes the place of the secondary one, so that the edit adjusts it
+		e.Cursor, e.Cursors[i] = e.Cursors[i], primary
+		command()
+		primary, e.Cursors[i] = e.Cursors[i], e.Cursor
+	}
+	e.Cursor = primary
+	// Rows inserted or deleted above the cursor at the other cursors move it on the screen
+	e.Cx, e.Cy, e.PrevCx = cx, cy+primary.RowIndex-edited.RowIndex, prevCx
+	if !primary.Equals(edited) {
+		e.PrevCx = -1 // Drawing computes Cx
+	}
+	e.uniqueCursors()
+}
 
-	//e.makeAvailableBoundariesArray(start.RowIndex) // -------- !
-	if count := stop.RowIndex - start.RowIndex; count > 0 {
-		e.bsArray.Delete(start.RowIndex+1, count)
+// Move every secondary cursor by move
+func (e *Editor) moveSecondaryCursors(move func(c file.Cursor) file.Cursor) {
+	for i, c := range e.Cursors {
+		e.Cursors[i] = move(c)
 	}
+}
 
-	e.syncCursorAndBufferForEdit(DELETE, start, stop)
-	e.UndoAction.PushAction(&file.EditAction{Class: file.DELETE_BACKWARD, Before: start, After: start, Data: *removed})
-	if err := kill_buffer.KillBuffer.PushKillBuffer([]byte(string(*removed))); err != nil {
-		e.screen.Echo(err.Error())
+// Cursor of the start of the next word, see MoveCursorNextWord
+func (e *Editor) nextWordCursor(c file.Cursor) file.Cursor {
+	lines := e.Rows()
+	if lines.Row(c.RowIndex).IsColIndexAtRowEnd(c.ColIndex) {
+		if lines.IsRowIndexLastRow(c.RowIndex) {
+			return c
+		}
+		return file.Cursor{RowIndex: c.RowIndex + 1, ColIndex: 0}
 	}
-}
 
-// Kill region between last mark to cursor
-// and push undo and kill buffers
-func (e *Editor) KillRegion() {
+	var prevCc, cc screen.CharClass
+	notUppercaseBit := ^screen.UPPERCASE
+	for {
+		ch, size, ok := lines.Row(c.RowIndex).DecodeRune(c.ColIndex)
+		if !ok {
+			break
+		}
+		prevCc = cc
+		cc = screen.GetCharClass(ch)
+		if prevCc != 0 {
+			if prevCc&screen.UPPERCASE == 0 && cc&screen.UPPERCASE > 0 {
+				break
+			}
+			prevCc &= notUppercaseBit
+			cc &= notUppercaseBit
+			if prevCc != cc && cc&screen.TAB == 0 && cc&screen.SPACE == 0 && cc&screen.SYMBOL == 0 {
+				break
+			}
+		}
+		c.ColIndex += size
+	}
+	return c
+}
+
+// Cursor of the start of the previous word, see MoveCursorPreviousWord
+func (e *Editor) prevWordCursor(c file.Cursor) file.Cursor {
+	lines := e.Rows()
+	if c.ColIndex == 0 {
+		if c.RowIndex == 0 {
+			return c
+		}
+		c.RowIndex--
+		_, _, c.ColIndex, _ = lines.Row(c.RowIndex).DecodeEndRune() // on linefeed
+		return c
+	}
+
+	var prevCc, cc screen.CharClass
+	notUppercaseBit := ^screen.UPPERCASE
+	for {
+		ch, _, colIndex, ok := lines.Row(c.RowIndex).DecodePrevRune(c.ColIndex)
+		if !ok {
+			break
+		}
+		prevCc = cc
+		cc = screen.GetCharClass(ch)
+		if prevCc != 0 {
+			if prevCc&notUppercaseBit != cc&notUppercaseBit && (cc&screen.TAB > 0 || cc&screen.SPACE > 0 || cc&screen.SYMBOL > 0) {
+				break
+			}
+		}
+		c.ColIndex = colIndex
+		if prevCc != 0 && prevCc&screen.UPPERCASE == 0 && cc&screen.UPPERCASE > 0 {
+			break
+		}
+	}
+	return c
+}
+
+// Move the cursor to c on the same or an adjacent row, the cursor keeps its place on the screen
+func (e *Editor) moveCursorTo(c file.Cursor) {
+	_, fromY := e.cursorPositionOnScreenLogicalRow(e.RowIndex, e.ColIndex)
+	x, toY := e.cursorPositionOnScreenLogicalRow(c.RowIndex, c.ColIndex)
+	if fromY < 0 || toY < 0 {
+		// Boundaries not computed yet, drawing computes Cx
+		e.Cy += c.RowIndex - e.RowIndex
+		e.Cursor = c
+		e.PrevCx = -1
+		return
+	}
+
+	y := e.Cy - fromY + toY
+	if c.RowIndex > e.RowIndex {
+		y += e.bsArray.BoundariesLen(e.RowIndex)
+	} else if c.RowIndex < e.RowIndex {
+		y -= e.bsArray.BoundariesLen(c.RowIndex)
+	}
+	e.Cursor = c
+	e.PrevCx = x
+	e.moveCursor(x, y)
+}
+
+// Column index of rowIndex nearest to colIndex on a rune, at most on the linefeed
+func (e *Editor) clampColIndex(rowIndex, colIndex int) int {
+	row := e.Rows().Row(rowIndex)
+	colIndex = min(colIndex, row.Length()-1)
+	for colIndex > 0 {
+		if _, _, ok := row.DecodeRune(colIndex); ok {
+			break
+		}
+		colIndex--
+	}
+	return colIndex
+}
+
+// ------------------------------------------------------------------
+// Mark
+// ------------------------------------------------------------------
+
+// Push a mark at the cursor to the mark ring of the buffer and activate the region
+func (e *Editor) SetMark() {
+	Marks.SetMark(e.newMark())
+	e.MarkActive = true
+	e.screen.Echo("Set mark")
+}
+
+// Remove the last mark of the buffer
+func (e *Editor) UnsetMark() {
+	m := Marks.FindLastByPath(e.GetPath())
+	if m == nil {
+		e.screen.Echo("The mark is not set now")
+		return
+	}
+	Marks.UnsetMark(m)
+	e.MarkActive = false
+	e.screen.Echo("Unset mark")
+}
+
+// Deactivate the region in transient mark mode, the mark stays
+func (e *Editor) DeactivateMark() {
+	e.MarkActive = false
+}
+
+func (e *Editor) SwapCursorAndMark() {
+	m := Marks.FindLastByPath(e.GetPath())
+	if m == nil {
+		e.screen.Echo("The mark is not set now, so there is no region")
+		return
+	}
+
+	Marks.UnsetMark(m)
+	Marks.SetMark(e.newMark())
+	e.Cursor = m.Cursor
+	e.MarkActive = true
+}
+
+// Jump to the last mark of the mark ring of the buffer, it becomes the oldest one
+// Repeating it goes around the ring
+func (e *Editor) PopMark() {
+	e.rotateMarks(Marks.FilterByPath(e.GetPath()), false)
+}
+
+// Jump to the oldest mark of the mark ring of the buffer, the reverse of PopMark
+func (e *Editor) UnpopMark() {
+	e.rotateMarks(Marks.FilterByPath(e.GetPath()), true)
+}
+
+// Jump to the last mark of all files, it becomes the oldest one
+// Repeating it goes around the marks of every file
+func (e *Editor) PopGlobalMark() {
+	e.rotateMarks(*Marks, false)
+}
+
+// Jump to the oldest mark of all files, the reverse of PopGlobalMark
+func (e *Editor) UnpopGlobalMark() {
+	e.rotateMarks(*Marks, true)
+}
+
+// Rotate ring, the oldest first, and jump to the mark taken out
+// Marks at the cursor are skipped
+func (e *Editor) rotateMarks(ring []*mark.Mark, reverse bool) {
+	ring = slices.Clone(ring)
+	for range ring {
+		var m *mark.Mark
+		if reverse {
+			m, ring = ring[0], append(ring[1:], ring[0])
+			Marks.MoveToBack(m)
+		} else {
+			m, ring = ring[len(ring)-1], append([]*mark.Mark{ring[len(ring)-1]}, ring[:len(ring)-1]...)
+			Marks.MoveToFront(m)
+		}
+		if m.FilePath != e.GetPath() || !m.Equals(e.Cursor) {
+			e.jumpToMark(m)
+			return
+		}
+	}
+	e.screen.Echo("No other mark")
+}
+
+// Store the cursor position in the register name, a to z
+func (e *Editor) PointToRegister(name rune) {
+	if err := Registers.Set(name, e.newMark()); err != nil {
+		e.screen.Echo(err.Error())
+		return
+	}
+	e.screen.Echo(fmt.Sprintf("Saved position to register %c", name))
+}
+
+// Jump to the position stored in the register name, in any file
+func (e *Editor) JumpToRegister(name rune) {
+	m := Registers.Get(name)
+	if m == nil {
+		e.screen.Echo(fmt.Sprintf("Register %c is empty", name))
+		return
+	}
+	e.jumpToMark(m)
+}
+
+// Registers and marks of all files for a minibuffer list, see JumpToMarkListItem
+// Registers come first in alphabetical order, then marks from the newest
+func (e *Editor) MarkListItems() []string {
+	items := []string{}
+	for _, name := range Registers.Names() {
+		items = append(items, markListItem(string(name), Registers.Get(name)))
+	}
+	for i := len(*Marks) - 1; i >= 0; i-- {
+		items = append(items, markListItem(" ", (*Marks)[i]))
+	}
+	return items
+}
+
+// Jump to the register or mark at index of MarkListItems
+func (e *Editor) JumpToMarkListItem(index int) {
+	names := Registers.Names()
+	if index >= 0 && index < len(names) {
+		e.jumpToMark(Registers.Get(names[index]))
+		return
+	}
+	index -= len(names)
+	if index < 0 || index >= len(*Marks) {
+		e.screen.Echo("No such mark")
+		return
+	}
+	e.jumpToMark((*Marks)[len(*Marks)-1-index])
+}
+
+func markListItem(label string, m *mark.Mark) string {
+	return fmt.Sprintf("%s %s:%d:%d %s", label, filepath.Base(m.FilePath), m.RowIndex+1, m.ColIndex+1, m.Content)
+}
+
+// Mark at the cursor with the text following it
+func (e *Editor) newMark() *mark.Mark {
+	return mark.NewMark(e.GetPath(), e.Cursor, e.getContentWidthoutSpecialCharactor(e.Cursor, 20))
+}
+
+// Move the cursor to m, opening its file if it is not the file of the editor
+func (e *Editor) jumpToMark(m *mark.Mark) {
+	if m.FilePath != e.GetPath() {
+		prevFile, prevMeta := e.File, e.Meta
+		if err := e.openFile(m.FilePath); err != nil {
+			if errors.Is(err, pkg_error.ErrorNewFile) {
+				// The marked file no longer exists, stay in the buffer instead of the empty one created for it
+				BufferSets.RemoveByBufferFile(e.File)
+				e.File, e.Meta = prevFile, prevMeta
+				e.bsArray.ClearAll()
+				e.screen.Echo(m.FilePath + " no longer exists")
+				return
+			}
+			e.screen.Echo(err.Error())
+			// Loading is reported as an error too, the jump stops only if the file was not loaded
+			if !errors.Is(err, pkg_error.ErrorLoadedFile) {
+				return
+			}
+		}
+	}
+	rowIndex := min(m.RowIndex, e.Rows().Length()-1)
+	e.Cursor = file.Cursor{RowIndex: rowIndex, ColIndex: e.clampColIndex(rowIndex, m.ColIndex)}
+	e.PrevCx = -1
+}
+
+// ------------------------------------------------------------------
+// Jump list
+// ------------------------------------------------------------------
+
+// Go back to the position before the last jump, in any file
+func (e *Editor) JumpBack() {
+	m := JumpList.Back(mark.NewMark(e.GetPath(), e.Cursor, ""))
+	if m == nil {
+		e.screen.Echo("No older jump")
+		return
+	}
+	e.jumpToMark(m)
+}
+
+// Go forward again after JumpBack
+func (e *Editor) JumpForward() {
+	m := JumpList.Forward()
+	if m == nil {
+		e.screen.Echo("No newer jump")
+		return
+	}
+	e.jumpToMark(m)
+}
+
+// Record the cursor position before a jump
+func (e *Editor) recordJump() {
+	if e.File == nil || e.Meta == nil {
+		return
+	}
+	JumpList.Push(mark.NewMark(e.GetPath(), e.Cursor, ""))
+}
+
+// ------------------------------------------------------------------
+// Region
+// ------------------------------------------------------------------
+
+// Copy cursor region to Kill Buffer and Clipboard
+func (e *Editor) CopyRegion() {
+	mark := Marks.FindLastByPath(e.GetPath())
+	if mark == nil {
+		e.screen.Echo("The mark is not set now, so there is no region")
+		return
+	}
+	if mark.RowIndex == e.RowIndex && mark.ColIndex == e.ColIndex {
+		e.screen.Echo("Mark and cursor position are the same, so there is no region")
+		return
+	}
+
+	var err error
+	if mark.RowIndex == e.RowIndex {
+		if mark.ColIndex > e.ColIndex {
+			err = e.copyRegion(e.Cursor, mark.Cursor)
+		} else {
+			err = e.copyRegion(mark.Cursor, e.Cursor)
+		}
+	} else if mark.RowIndex > e.RowIndex {
+		err = e.copyRegion(e.Cursor, mark.Cursor)
+	} else {
+		err = e.copyRegion(mark.Cursor, e.Cursor)
+	}
+	e.DeactivateMark()
+	if err != nil {
+		e.screen.Echo("Copied, " + err.Error())
+	} else {
+		e.screen.Echo("Copied")
+	}
+}
+
+// Delete start to stop bytes and push the bytes to undo-stack and kill-buffer
+// 開始から終了までのバイトを削除し、そのバイトを undo スタックと kill バッファにプッシュする
+// Undone like a backward deletion, so consecutive kills stay separate undo steps
+func (e *Editor) killRegion(start, stop file.Cursor) {
+	removed := e.deleteRegionAs(file.DELETE_BACKWARD, start, stop)
+	if removed == nil {
+		return
+	}
+	if err := pushKillBuffer([]byte(string(removed))); err != nil {
+		e.screen.Echo(err.Error())
+	}
+}
+
+// Delete start to stop bytes and push the bytes to undo-stack
+func (e *Editor) deleteRegion(start, stop file.Cursor) []byte {
+	return e.deleteRegionAs(file.DELETE, start, stop)
+}
+
+// Delete start to stop bytes and push them to undo-stack as class, DELETE or DELETE_BACKWARD
+func (e *Editor) deleteRegionAs(class file.ActionClass, start, stop file.Cursor) []byte {
+	e.Cursor = start
+	terminators := e.GetTerminators(start, stop)
+	removed := e.RemoveRegion(start, stop)
+	if removed == nil {
+		return nil
+	}
+
+	//e.makeAvailableBoundariesArray(start.RowIndex) // -------- !
+	if count := stop.RowIndex - start.RowIndex; count > 0 {
+		e.bsArray.Delete(start.RowIndex+1, count)
+	}
+
+	e.syncCursorAndBufferForEdit(DELETE, start, stop)
+	before := start
+	if class == file.DELETE_BACKWARD {
+		before = stop
+	}
+	e.UndoAction.PushAction(&file.EditAction{Class: class, Before: before, After: start, Data: *removed, FromTerminators: terminators})
+	return *removed
+}
+
+// Kill region between last mark to cursor
+// and push undo and kill buffers
+func (e *Editor) KillRegion() {
 	mark := Marks.FindLastByPath(e.GetPath())
 	if mark == nil {
 		e.screen.Echo("The mark is not set now, so there is no region")
@@ -870,6 +1449,7 @@ func (e *Editor) KillRegion() {
 	} else {
 		e.killRegion(mark.Cursor, e.Cursor)
 	}
+	e.DeactivateMark()
 	e.screen.Echo("Copied")
 }
 
@@ -898,8 +1478,30 @@ func (e Editor) BackwardKillLine() {
 // 行を削除します:
 // EOL でない場合は、カーソルから末尾までの現在の行の内容を削除します。
 // それ以外の場合は、「delete」のように動作します。
+// Consecutive kill lines append to the same kill ring entry
 func (e *Editor) KillLine() {
-	var removed *[]byte
+	appending := e.lastKill != nil && *e.lastKill == e.killState()
+
+	// The kills of the cursors are one entry, one line each: a killed linefeed ends its line already
+	var killed []byte
+	e.forEachCursor(func() {
+		if removed := e.killLine(); removed != nil {
+			if len(killed) > 0 && killed[len(killed)-1] != '\n' {
+				killed = append(killed, '\n')
+			}
+			killed = append(killed, removed...)
+		}
+	})
+	if killed != nil {
+		e.pushKill(killed, appending)
+	}
+	e.lastKill = new(killState)
+	*e.lastKill = e.killState()
+}
+
+// Kill to the end of the row, or the linefeed if the cursor is at the end of the row
+// Returns the killed bytes
+func (e *Editor) killLine() []byte {
 	stop := e.Cursor
 
 	lines := e.Rows()
@@ -909,72 +1511,587 @@ func (e *Editor) KillLine() {
 	if line.IsColIndexAtRowEnd(e.ColIndex) {
 		if lines.IsRowIndexLastRow(e.RowIndex) {
 			e.screen.Echo("End of buffer")
-			return
+			return nil
 		}
 		// delete linefeed
-		e.DeleteRune()
-		return
-	}
-
-	// l, _ := lines.GetColLength(e.RowIndex)
-	l := lines.Row(e.RowIndex).Length()
-	stop.ColIndex = l - 1
-	removed = e.RemoveRegion(e.Cursor, stop)
-	if removed == nil {
-		return
-	}
-
-	// e.screen.Echo(fmt.Sprintf("KillLine %d:%d", start.RowIndex+1, stop.RowIndex+1))
-	//e.makeAvailableBoundariesArray(e.RowIndex) // -------- !
-	if count := stop.RowIndex - e.RowIndex; count > 0 {
-		e.bsArray.Delete(e.RowIndex+1, count)
+		stop = file.Cursor{RowIndex: e.RowIndex + 1, ColIndex: 0}
+	} else {
+		stop.ColIndex = line.Length() - 1
 	}
-	// e.bsay.bsayDelete(e.RowIndex+1, stop.RowIndex+1)
-
-	e.syncCursorAndBufferForEdit(DELETE, e.Cursor, stop)
-	e.UndoAction.PushAction(&file.EditAction{Class: file.DELETE, Before: e.Cursor, After: e.Cursor, Data: *removed})
 
+	removed := e.deleteRegion(e.Cursor, stop)
 	e.PrevCx = -1
+	return removed
 }
 
 // ------------------------------------------------------------------
-// Yank
+// Kill ring
 // ------------------------------------------------------------------
 
-func (e *Editor) YankFromClipboard() {
-	s, err := clipboard.ReadAll()
-	if err != nil {
-		e.screen.Echo(err.Error())
-		return
-	}
-	e.insertBytes([]byte(s), true)
+// State after KillLine, the next KillLine appends to its kill if nothing changed in between
+type killState struct {
+	cursor  file.Cursor
+	changes int // UndoStack.Changes
+	length  int // Number of kill ring entries
 }
 
-func (e *Editor) Yank() {
-	r := kill_buffer.KillBuffer.GetLast()
-	if r == nil {
-		return
-	}
-	e.insertBytes(r, true)
+// Where the last yank inserted text, YankPop replaces it if nothing changed in between
+type yankState struct {
+	start, stop file.Cursor
+	index       int // Kill ring entry, 0 is the newest
+	changes     int // UndoStack.Changes
 }
 
-// ------------------------------------------------------------------
-// Undo / Redo
-// ------------------------------------------------------------------
+func (e *Editor) killState() killState {
+	return killState{cursor: e.Cursor, changes: e.UndoAction.Changes(), length: len(*kill_buffer.KillBuffer)}
+}
 
-func (e *Editor) Undo() {
-	if e.UndoAction.IsUndoEmpty() {
-		e.screen.Echo("No further undo information")
+// Push killed bytes to the kill ring, or append them to the newest entry
+func (e *Editor) pushKill(data []byte, appending bool) {
+	ring := *kill_buffer.KillBuffer
+	if !appending || len(ring) == 0 {
+		if err := pushKillBuffer(data); err != nil {
+			e.screen.Echo(err.Error())
+		}
 		return
 	}
+	last := append(bytes.Clone(ring[len(ring)-1]), data...)
+	ring[len(ring)-1] = last
+	if err := clipboard.Write(string(last)); err != nil {
+		e.screen.Echo(err.Error())
+	}
+}
 
-	actions := e.UndoAction.Undo() //.Pop()
-	for _, a := range actions {
-		// verb.PP("e.UndoAction.Pop() %v %v '%s'", a.Before, a.After, string(a.Data))
-		if a.Class == file.INSERT {
-			e.RemoveRegion(a.Before, a.After)
+// Push data to the kill ring and write it to the system clipboard
+func pushKillBuffer(data []byte) error {
+	pushKillRing(data)
+	return clipboard.Write(string(data))
+}
 
-			// e.screen.Echo(fmt.Sprintf("Undo %d:%d", start.RowIndex+1, stop.RowIndex+1))
+// Push data to the kill ring only
+// KillBuffer.PushKillBuffer also writes the clipboard by itself, the clipboard providers do it instead
+func pushKillRing(data []byte) {
+	*kill_buffer.KillBuffer = append(*kill_buffer.KillBuffer, data)
+}
+
+// Reading the clipboard runs programs such as xclip and tmux, it is read in the background at most every clipboardPullInterval
+const clipboardPullInterval = time.Second
+
+var clipboardPull struct {
+	mutex   sync.Mutex
+	running bool
+	last    time.Time
+	text    []byte // Put on the clipboard by another program, pushed to the kill ring by flushClipboard
+}
+
+// Start reading the clipboard in the background, the text another program put there becomes the newest kill ring entry
+// Called for every event, a yank right after copying in another program may still yank the previous entry
+func pullClipboard(s *screen.Screen) {
+	p := &clipboardPull
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.running || time.Since(p.last) < clipboardPullInterval {
+		return
+	}
+	p.running, p.last = true, time.Now()
+	go func() {
+		text, ok := clipboard.Changed()
+		p.mutex.Lock()
+		p.running = false
+		if ok {
+			p.text = []byte(text)
+		}
+		p.mutex.Unlock()
+		if ok {
+			s.PostEvent(tcell.NewEventInterrupt(nil))
+		}
+	}()
+}
+
+// Push the clipboard text read in the background to the kill ring
+// Called from the event loop, the reading goroutine only sets text
+func flushClipboard() {
+	p := &clipboardPull
+	p.mutex.Lock()
+	text := p.text
+	p.text = nil
+	p.mutex.Unlock()
+	if text != nil && !bytes.Equal(text, killRingEntry(0)) {
+		pushKillRing(text)
+	}
+}
+
+// Entry of the kill ring, 0 is the newest
+// Returns nil if there is no such entry
+func killRingEntry(index int) []byte {
+	ring := *kill_buffer.KillBuffer
+	if index < 0 || index >= len(ring) {
+		return nil
+	}
+	return ring[len(ring)-1-index]
+}
+
+// Replace the text inserted by the last yank with the next older kill ring entry
+// After the oldest entry it goes around to the newest one
+func (e *Editor) YankPop() {
+	y := e.lastYank
+	if y == nil || y.changes != e.UndoAction.Changes() || !e.Cursor.Equals(y.stop) {
+		e.screen.Echo("Previous command was not a yank")
+		return
+	}
+
+	e.BeginUndoGroup()
+	e.deleteRegion(y.start, y.stop)
+	e.yank((y.index + 1) % len(*kill_buffer.KillBuffer))
+	e.EndUndoGroup()
+	e.lastYank.changes = e.UndoAction.Changes()
+}
+
+// Previews of the kill ring entries for a minibuffer list, the newest first
+// Each preview is one line at most maxWidth wide
+func (e *Editor) KillRingPreviews(maxWidth int) []string {
+	ring := *kill_buffer.KillBuffer
+	previews := make([]string, len(ring))
+	for i := range ring {
+		previews[i] = killPreview(killRingEntry(i), maxWidth)
+	}
+	return previews
+}
+
+// Insert the kill ring entry at index of KillRingPreviews, it becomes the newest entry
+func (e *Editor) YankKillRingEntry(index int) {
+	n := len(*kill_buffer.KillBuffer)
+	if index < 0 || index >= n {
+		e.screen.Echo("No such kill ring entry")
+		return
+	}
+	kill_buffer.KillBuffer.Get(n - 1 - index)
+	e.yank(0)
+}
+
+// Insert the kill ring entry at index and remember it for YankPop
+func (e *Editor) yank(index int) {
+	r := killRingEntry(index)
+	if r == nil {
+		e.screen.Echo("Kill ring is empty")
+		return
+	}
+	start := e.Cursor
+	e.insertBytes(bytes.Clone(r), true)
+	e.lastYank = &yankState{start: start, stop: e.Cursor, index: index, changes: e.UndoAction.Changes()}
+}
+
+// One line preview of data, linefeeds, tabs and control codes are shown as marks
+// A preview cut at maxWidth ends with the continue mark
+func killPreview(data []byte, maxWidth int) string {
+	preview := []rune{}
+	widths := []int{}
+	width := 0
+	for _, ch := range string(data) {
+		w := utils.RuneWidth(ch)
+		switch {
+		case ch == '\n':
+			ch, w = theme.MarkLinefeed, 1
+		case ch == '\t':
+			ch, w = theme.MarkTab, 1
+		case ch < 32 || ch == define.DEL:
+			ch, w = theme.MarkContinue, 1
+		}
+		preview = append(preview, ch)
+		widths = append(widths, w)
+		width += w
+	}
+	if width <= maxWidth {
+		return string(preview)
+	}
+	for width > maxWidth-1 && len(preview) > 0 {
+		width -= widths[len(widths)-1]
+		preview, widths = preview[:len(preview)-1], widths[:len(widths)-1]
+	}
+	return string(append(preview, theme.MarkContinue))
+}
+
+// ------------------------------------------------------------------
+// Rectangle
+// ------------------------------------------------------------------
+
+// Lines of the last killed or copied rectangle
+var killedRectangle [][]byte
+
+// Rectangle of display columns, left is inclusive and right is exclusive
+type rectangle struct {
+	startRowIndex, stopRowIndex int
+	left, right                 int
+}
+
+// Kill the rectangle whose opposite corners are the mark and the cursor
+func (e *Editor) KillRectangle() {
+	r, ok := e.regionRectangle()
+	if !ok {
+		return
+	}
+	lines := make([][]byte, 0, r.stopRowIndex-r.startRowIndex+1)
+	e.editRectangle(r, func(rowIndex int) {
+		e.splitTabs(rowIndex, r.left, r.right)
+		lines = append(lines, e.rectangleLine(rowIndex, r))
+		start, stop, _, _ := e.rectangleRange(rowIndex, r)
+		e.deleteRegion(start, stop)
+	})
+	killedRectangle = lines
+	e.moveToRectangle(r)
+	e.DeactivateMark()
+	e.screen.Echo("Killed rectangle")
+}
+
+// Copy the rectangle whose opposite corners are the mark and the cursor
+func (e *Editor) CopyRectangle() {
+	r, ok := e.regionRectangle()
+	if !ok {
+		return
+	}
+	lines := make([][]byte, 0, r.stopRowIndex-r.startRowIndex+1)
+	for rowIndex := r.startRowIndex; rowIndex <= r.stopRowIndex; rowIndex++ {
+		lines = append(lines, e.rectangleLine(rowIndex, r))
+	}
+	killedRectangle = lines
+	e.DeactivateMark()
+	e.screen.Echo("Copied rectangle")
+}
+
+// Insert the last killed rectangle with its upper left corner at the cursor
+// Rows are added at the end of the buffer if needed
+func (e *Editor) YankRectangle() {
+	if killedRectangle == nil {
+		e.screen.Echo("No rectangle to yank")
+		return
+	}
+	defer e.undoGroup()()
+
+	rowIndex := e.RowIndex
+	column := e.displayColumn(e.RowIndex, e.ColIndex)
+	for i, line := range killedRectangle {
+		if rowIndex+i >= e.Rows().Length() {
+			last := e.Rows().Length() - 1
+			e.Cursor = file.Cursor{RowIndex: last, ColIndex: e.Rows().Row(last).Length() - 1}
+			e.insertBytes([]byte{'\n'}, true)
+		}
+		e.insertAtColumn(rowIndex+i, column, line)
+	}
+	e.PrevCx = -1
+}
+
+// Insert blanks in the rectangle, the text in it moves to the right
+// Rows ending at or before the left edge are not changed
+func (e *Editor) OpenRectangle() {
+	r, ok := e.regionRectangle()
+	if !ok {
+		return
+	}
+	e.editRectangle(r, func(rowIndex int) {
+		if colIndex, _ := e.colIndexAtColumn(rowIndex, r.left); colIndex == e.Rows().Row(rowIndex).Length()-1 {
+			return
+		}
+		e.insertAtColumn(rowIndex, r.left, bytes.Repeat([]byte{' '}, r.right-r.left))
+	})
+	e.moveToRectangle(r)
+}
+
+// Replace the text in the rectangle with blanks
+// Text after the rectangle stays at the same column
+func (e *Editor) ClearRectangle() {
+	r, ok := e.regionRectangle()
+	if !ok {
+		return
+	}
+	e.editRectangle(r, func(rowIndex int) {
+		e.splitTabs(rowIndex, r.left, r.right)
+		start, stop, startColumn, stopColumn := e.rectangleRange(rowIndex, r)
+		if start == stop {
+			return
+		}
+		atRowEnd := stop.ColIndex == e.Rows().Row(rowIndex).Length()-1
+		e.deleteRegion(start, stop)
+		if !atRowEnd {
+			e.insertBytes(bytes.Repeat([]byte{' '}, stopColumn-startColumn), true)
+		}
+	})
+	e.moveToRectangle(r)
+}
+
+// Insert s at the left edge of the rectangle on every row
+// Rows ending before the rectangle are padded with spaces
+func (e *Editor) InsertRectangleString(s string) {
+	r, ok := e.regionRectangle()
+	if !ok {
+		return
+	}
+	e.editRectangle(r, func(rowIndex int) {
+		e.insertAtColumn(rowIndex, r.left, []byte(s))
+	})
+	e.PrevCx = -1
+}
+
+// Rectangle whose opposite corners are the mark and the cursor
+func (e *Editor) regionRectangle() (r rectangle, ok bool) {
+	m := Marks.FindLastByPath(e.GetPath())
+	if m == nil || m.RowIndex >= e.Rows().Length() {
+		e.screen.Echo("The mark is not set now, so there is no region")
+		return r, false
+	}
+	markColumn := e.displayColumn(m.RowIndex, e.clampColIndex(m.RowIndex, m.ColIndex))
+	cursorColumn := e.displayColumn(e.RowIndex, e.ColIndex)
+	r.startRowIndex, r.stopRowIndex = min(m.RowIndex, e.RowIndex), max(m.RowIndex, e.RowIndex)
+	r.left, r.right = min(markColumn, cursorColumn), max(markColumn, cursorColumn)
+	return r, true
+}
+
+// Edit every row of the rectangle as one undo group
+func (e *Editor) editRectangle(r rectangle, edit func(rowIndex int)) {
+	defer e.undoGroup()()
+	for rowIndex := r.startRowIndex; rowIndex <= r.stopRowIndex; rowIndex++ {
+		edit(rowIndex)
+		e.bsArray.Set(rowIndex, nil) // Compute the tab widths again
+	}
+}
+
+// Move the cursor to the upper left corner of the rectangle
+func (e *Editor) moveToRectangle(r rectangle) {
+	colIndex, _ := e.colIndexAtColumn(r.startRowIndex, r.left)
+	e.Cursor = file.Cursor{RowIndex: r.startRowIndex, ColIndex: colIndex}
+	e.PrevCx = -1
+}
+
+// Text of the rectangle in rowIndex, padded with spaces to the width of the rectangle
+// Characters crossing an edge are replaced by spaces
+func (e *Editor) rectangleLine(rowIndex int, r rectangle) []byte {
+	start, stop, startColumn, stopColumn := e.rectangleRange(rowIndex, r)
+	if startColumn < r.left {
+		return bytes.Repeat([]byte{' '}, r.right-r.left)
+	}
+	line := make([]byte, 0, r.right-r.left+stop.ColIndex-start.ColIndex)
+	line = append(line, bytes.Repeat([]byte{' '}, startColumn-r.left)...)
+	line = append(line, e.Rows().Row(rowIndex).Bytes()[start.ColIndex:stop.ColIndex]...)
+	return append(line, bytes.Repeat([]byte{' '}, r.right-stopColumn)...)
+}
+
+// Range of the characters of rowIndex inside the rectangle and the display columns where they start and stop
+// Characters crossing an edge are out of the range, startColumn is less than left if the row ends before the rectangle
+func (e *Editor) rectangleRange(rowIndex int, r rectangle) (start, stop file.Cursor, startColumn, stopColumn int) {
+	startColIndex, startColumn := e.colIndexAtColumn(rowIndex, r.left)
+	stopColIndex, stopColumn := e.walkColumns(rowIndex, func(colIndex, column, width int, ch rune) bool {
+		return column+width <= r.right
+	})
+	if stopColIndex < startColIndex {
+		stopColIndex, stopColumn = startColIndex, startColumn
+	}
+	start = file.Cursor{RowIndex: rowIndex, ColIndex: startColIndex}
+	stop = file.Cursor{RowIndex: rowIndex, ColIndex: stopColIndex}
+	return start, stop, startColumn, stopColumn
+}
+
+// Insert data at column of rowIndex, a row ending before column is padded with spaces
+func (e *Editor) insertAtColumn(rowIndex, column int, data []byte) {
+	e.splitTabs(rowIndex, column)
+	colIndex, start := e.colIndexAtColumn(rowIndex, column)
+	if start < column {
+		data = append(bytes.Repeat([]byte{' '}, column-start), data...)
+	}
+	e.Cursor = file.Cursor{RowIndex: rowIndex, ColIndex: colIndex}
+	e.insertBytes(data, true)
+	e.bsArray.Set(rowIndex, nil)
+}
+
+// Replace tabs crossing the columns of rowIndex by spaces of the same width
+func (e *Editor) splitTabs(rowIndex int, columns ...int) {
+	for _, c := range columns {
+		colIndex, column := e.walkColumns(rowIndex, func(colIndex, column, width int, ch rune) bool {
+			return !(ch == '\t' && column < c && c < column+width)
+		})
+		if ch, _, _ := e.Rows().Row(rowIndex).DecodeRune(colIndex); ch != '\t' {
+			continue
+		}
+		width := e.charWidth(rowIndex, colIndex, column, '\t')
+		e.deleteRegion(file.Cursor{RowIndex: rowIndex, ColIndex: colIndex}, file.Cursor{RowIndex: rowIndex, ColIndex: colIndex + 1})
+		e.insertBytes(bytes.Repeat([]byte{' '}, width), true)
+		e.bsArray.Set(rowIndex, nil)
+	}
+}
+
+// Display column of colIndex in rowIndex, counted from the beginning of the row
+func (e *Editor) displayColumn(rowIndex, colIndex int) int {
+	_, column := e.walkColumns(rowIndex, func(i, column, width int, ch rune) bool {
+		return i < colIndex
+	})
+	return column
+}
+
+// First character of rowIndex starting at column or after, and its display column
+// The linefeed if the row ends before column
+func (e *Editor) colIndexAtColumn(rowIndex, column int) (colIndex, start int) {
+	return e.walkColumns(rowIndex, func(i, c, width int, ch rune) bool {
+		return c < column
+	})
+}
+
+// Walk the characters of rowIndex while f returns true
+// Returns the column index and display column of the character f returned false, the linefeed if none
+func (e *Editor) walkColumns(rowIndex int, f func(colIndex, column, width int, ch rune) bool) (colIndex, column int) {
+	e.bsArray.beAvailable(rowIndex) // Tab widths are recorded in specialCharWidths
+	row := e.Rows().Row(rowIndex)
+	for colIndex < row.Length()-1 {
+		ch, size, ok := row.DecodeRune(colIndex)
+		if !ok {
+			break
+		}
+		width := e.charWidth(rowIndex, colIndex, column, ch)
+		if !f(colIndex, column, width, ch) {
+			break
+		}
+		colIndex += size
+		column += width
+	}
+	return colIndex, column
+}
+
+// Width of a character on the screen, see drawLine
+func (e *Editor) charWidth(rowIndex, colIndex, column int, ch rune) int {
+	if ch == '\t' {
+		if rowIndex < len(e.specialCharWidths) {
+			if w, ok := e.specialCharWidths[rowIndex][colIndex]; ok {
+				return w
+			}
+		}
+		return utils.TabWidth(column, e.GetTabWidth())
+	}
+	if is(screen.GetCharClass(ch), screen.CONTROLCODE) {
+		return 2 // ^X
+	}
+	return utils.RuneWidth(ch)
+}
+
+// ------------------------------------------------------------------
+// Yank
+// ------------------------------------------------------------------
+
+func (e *Editor) YankFromClipboard() {
+	s, err := clipboard.Read()
+	if err != nil {
+		e.screen.Echo(err.Error())
+		return
+	}
+	e.insertBytes([]byte(s), true)
+}
+
+// Insert the newest kill ring entry, YankPop replaces it with older ones
+// Text put on the system clipboard by another program is the newest entry
+func (e *Editor) Yank() {
+	flushClipboard()
+	e.yank(0)
+}
+
+// ------------------------------------------------------------------
+// Undo / Redo
+// ------------------------------------------------------------------
+
+// BeginUndoGroup makes the following edits one undo step until EndUndoGroup
+// Undo of the step moves the cursor back to where it is now
+func (e *Editor) BeginUndoGroup() {
+	e.UndoAction.BeginGroup(e.Cursor)
+}
+
+func (e *Editor) EndUndoGroup() {
+	e.UndoAction.EndGroup()
+}
+
+// Make a command one undo step
+//
+//	defer e.undoGroup()()
+func (e *Editor) undoGroup() func() {
+	e.BeginUndoGroup()
+	return e.EndUndoGroup
+}
+
+func (e *Editor) Undo() {
+	if e.UndoAction.IsUndoEmpty() {
+		e.screen.Echo("No further undo information")
+		return
+	}
+
+	e.undoActions(e.UndoAction.Undo()) //.Pop()
+	e.screen.Echo("Undo!")
+	// e.RedoAction.Push(a)
+}
+
+func (e *Editor) Redo() {
+	if e.UndoAction.IsRedoEmpty() {
+		e.screen.Echo("No further redo information")
+		return
+	}
+
+	e.redoActions(e.UndoAction.Redo())
+	e.screen.Echo("Redo!")
+	// e.UndoAction.Push(a)
+}
+
+// Move to the next sibling branch of the undo tree
+func (e *Editor) UndoNextBranch() {
+	e.switchUndoBranch(1)
+}
+
+// Move to the previous sibling branch of the undo tree
+func (e *Editor) UndoPrevBranch() {
+	e.switchUndoBranch(-1)
+}
+
+func (e *Editor) switchUndoBranch(delta int) {
+	undo, redo := e.UndoAction.SwitchBranch(delta)
+	if undo == nil {
+		e.screen.Echo("No other branch")
+		return
+	}
+	e.moveUndoTree(undo, redo)
+	index, count := e.UndoAction.Branch()
+	e.screen.Echo(fmt.Sprintf("Branch %d/%d", index, count))
+}
+
+// Restore the buffer as it was at t, on any branch of the undo tree
+func (e *Editor) UndoToTime(t time.Time) {
+	e.moveUndoTree(e.UndoAction.MoveToTime(t))
+	if e.UndoAction.IsUndoEmpty() {
+		e.screen.Echo("Original state")
+		return
+	}
+	e.screen.Echo("State of " + e.UndoAction.Time().Format(time.DateTime))
+}
+
+// Restore the buffer as it was d before the current state
+func (e *Editor) UndoEarlier(d time.Duration) {
+	e.UndoToTime(e.UndoAction.Time().Add(-d))
+}
+
+// Restore the buffer as it was d after the current state
+func (e *Editor) UndoLater(d time.Duration) {
+	e.UndoToTime(e.UndoAction.Time().Add(d))
+}
+
+// Apply the actions of a move in the undo tree
+func (e *Editor) moveUndoTree(undo, redo [][]*file.EditAction) {
+	for _, actions := range undo {
+		e.undoActions(actions)
+	}
+	for _, actions := range redo {
+		e.redoActions(actions)
+	}
+}
+
+// Revert actions returned by UndoStack
+func (e *Editor) undoActions(actions []*file.EditAction) {
+	for _, a := range actions {
+		// verb.PP("e.UndoAction.Pop() %v %v '%s'", a.Before, a.After, string(a.Data))
+		if a.Class == file.INSERT {
+			e.RemoveRegion(a.Before, a.After)
+
+			// e.screen.Echo(fmt.Sprintf("Undo %d:%d", start.RowIndex+1, stop.RowIndex+1))
 			//e.makeAvailableBoundariesArray(a.Before.RowIndex) // -------- !
 			// e.bsay.bsayDelete(a.Before.RowIndex+1, a.After.RowIndex+1)
 			if count := a.After.RowIndex - a.Before.RowIndex; count > 0 {
@@ -986,32 +2103,33 @@ func (e *Editor) Undo() {
 		} else if a.Class == file.DELETE {
 			e.Cursor = a.Before
 			e.insertBytes(a.Data, false)
+			e.SetTerminators(a.Before.RowIndex, a.FromTerminators)
 			e.syncCursorAndBufferForEdit(INSERT, a.Before, a.After)
 			e.Cursor = a.Before
 		} else if a.Class == file.DELETE_BACKWARD {
 			e.Cursor = a.After
 			e.insertBytes(a.Data, false)
+			e.SetTerminators(a.After.RowIndex, a.FromTerminators)
 			e.syncCursorAndBufferForEdit(INSERT, a.After, a.Before)
+		} else if a.Class == file.LINEFEED {
+			e.SetRowLinefeeds(a.From, a.FromTerminators)
+		} else if a.Class == file.CHARSET {
+			e.SetEncoding(a.From)
+		} else if a.Class == file.CURSOR {
+			e.Cursor = a.Before
 		} else {
 			return
 		}
 	}
-
-	e.screen.Echo("Undo!")
-	// e.RedoAction.Push(a)
 }
 
-func (e *Editor) Redo() {
-	if e.UndoAction.IsRedoEmpty() {
-		e.screen.Echo("No further redo information")
-		return
-	}
-
-	actions := e.UndoAction.Redo()
+// Apply actions returned by UndoStack again
+func (e *Editor) redoActions(actions []*file.EditAction) {
 	for _, a := range actions {
 		if a.Class == file.INSERT {
 			e.Cursor = a.Before
 			e.insertBytes(a.Data, false)
+			e.SetTerminators(a.Before.RowIndex, a.ToTerminators)
 		} else if a.Class == file.DELETE_BACKWARD {
 			e.RemoveRegion(a.After, a.Before)
 
@@ -1024,15 +2142,7 @@ func (e *Editor) Redo() {
 
 			e.syncCursorAndBufferForEdit(DELETE, a.After, a.Before)
 		} else if a.Class == file.DELETE {
-			lines := file.SplitByLF(a.Data)
-			last := lines[len(lines)-1]
-			cursor := a.After
-			cursor.RowIndex += len(lines) - 1
-			cursor.ColIndex += len(last)
-			if last[len(last)-1] == '\n' {
-				cursor.RowIndex++
-				cursor.ColIndex = 0
-			}
+			cursor := file.EndCursor(a.After, a.Data)
 			e.RemoveRegion(a.Before, cursor)
 
 			// e.screen.Echo(fmt.Sprintf("Redo DELETE %d:%d", a.Before.RowIndex+1, cursor.RowIndex+1))
@@ -1043,14 +2153,17 @@ func (e *Editor) Redo() {
 			}
 
 			e.syncCursorAndBufferForEdit(DELETE, a.Before, cursor)
+		} else if a.Class == file.LINEFEED {
+			e.SetRowLinefeeds(a.To, a.ToTerminators)
+		} else if a.Class == file.CHARSET {
+			e.SetEncoding(a.To)
+		} else if a.Class == file.CURSOR {
+			// Moved to After below
 		} else {
 			return
 		}
 		e.Cursor = a.After
 	}
-
-	e.screen.Echo("Redo!")
-	// e.UndoAction.Push(a)
 }
 
 // ------------------------------------------------------------------
@@ -1085,6 +2198,7 @@ func (e *Editor) MoveNextFoundWord() {
 		e.currentSearchIndex = len(e.foundIndexes) - 1
 	}
 
+	e.recordJump()
 	f := e.foundIndexes[e.currentSearchIndex]
 	e.RowIndex = f.start.RowIndex
 	e.ColIndex = f.start.ColIndex
@@ -1114,41 +2228,50 @@ func (e *Editor) MovePrevFoundWord() {
 		e.currentSearchIndex = len(e.foundIndexes) - 1
 	}
 
+	e.recordJump()
 	e.RowIndex = e.foundIndexes[e.currentSearchIndex].start.RowIndex
 	e.ColIndex = e.foundIndexes[e.currentSearchIndex].start.ColIndex
 }
 
-// When not using regular expressions
-func (e *Editor) SearchText(text string, caseSensitive, isRegexp bool, ctx context.Context, wg *sync.WaitGroup) {
+// Search text with opts, the matches are highlighted and visited by MoveNextFoundWord
+func (e *Editor) SearchText(text string, opts SearchOptions, ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	e.currentSearchIndex = -1
 	e.foundIndexes = []foundPosition{}
+	e.foundRegexp = nil
 
 	textLen := len(text)
 	if textLen == 0 {
 		return
 	}
 
-	if isRegexp {
-		e.SearchRegexp(text, caseSensitive, ctx)
+	if opts.Multiline {
+		e.SearchMultilineRegexp(text, opts, ctx)
+	} else if opts.Regexp {
+		e.SearchRegexp(text, opts, ctx)
 	} else {
-		e.searchText(text, caseSensitive, ctx)
+		e.searchText(text, opts, ctx)
 	}
 }
 
-func (e *Editor) SearchRegexp(searchTerm string, caseSensitive bool, ctx context.Context) {
-	// rows := e.Rows__()
-	rows := e.Rows()
-	re, err := regexp.Compile(searchTerm)
+// Regular expression search on each row, opts.Regexp is implied
+// A pattern error is shown in the minibuffer
+func (e *Editor) SearchRegexp(searchTerm string, opts SearchOptions, ctx context.Context) {
+	opts.Regexp = true
+	re, err := opts.compile(searchTerm)
 	if err != nil {
+		e.screen.Echo(err.Error())
+		return
+	}
+	accept, ok := e.searchFilter(opts)
+	if !ok {
 		return
 	}
+	e.foundRegexp = re
+	rows := e.Rows()
 	for i := 0; i < rows.Length(); i++ {
-		//s := rows.Row__(i).String__()
-		matches := re.FindAllSubmatchIndex((*rows)[i], -1)
-		// s := string((*rows)[i])
-		// matches := re.FindAllStringSubmatchIndex(s, -1)
+		matches := re.FindAllSubmatchIndex(e.rowText(i), -1)
 		if matches == nil {
 			continue
 		}
@@ -1157,85 +2280,1365 @@ func (e *Editor) SearchRegexp(searchTerm string, caseSensitive bool, ctx context
 			case <-ctx.Done():
 				return
 			default:
-				//startIndex := utf8.RuneCountInString(s[:match[0]])
-				//endIndex := utf8.RuneCountInString(s[:match[1]])
-				//e.searchIndexes = append(e.searchIndexes, foundPosition{startRowIndex: i, startColIndex: startIndex, endRowIndex: i, endColIndex: endIndex})
-				e.foundIndexes = append(e.foundIndexes, newFoundPosition(i, match[0], i, match[1]))
-			}
-		}
-	}
-}
-
-func (e *Editor) searchText(text string, caseSensitive bool, ctx context.Context) {
-	if !caseSensitive {
-		text = strings.ToLower(text)
-	}
-	textBytes := []byte(text)
-	textBytesLen := len(textBytes)
-
-	lines := e.Rows()
-	for i := 0; i < lines.Length(); i++ {
-		line := (*lines)[i]
-		index := 0
-	loop:
-		for limit := 0; ; limit++ {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				substring := line[index:]
-				if !caseSensitive {
-					substring = bytes.ToLower(substring)
+				found := newFoundPosition(i, match[0], i, match[1])
+				found.submatches = relativeSubmatches(match)
+				if accept(found) {
+					e.foundIndexes = append(e.foundIndexes, found)
 				}
-				findIndex := bytes.Index(substring, textBytes)
-				if findIndex == -1 {
-					break loop
-				}
-				startIndex := len(line[:index+findIndex])
-				stopIndex := startIndex + textBytesLen
-				e.foundIndexes = append(e.foundIndexes, newFoundPosition(i, startIndex, i, stopIndex))
-				index += findIndex + textBytesLen
-			}
-
-			if limit > 100_000 {
-				e.screen.Echo("Search text over 100,000")
-				return
 			}
 		}
 	}
 }
 
-func (e *Editor) ReplaceCurrentSearchString(str string) {
-	if e.currentSearchIndex == -1 {
+// Search on the whole buffer, a match can span rows
+// A literal text is quoted unless opts.Regexp, (?s) lets . match a linefeed
+func (e *Editor) SearchMultilineRegexp(searchTerm string, opts SearchOptions, ctx context.Context) {
+	re, err := opts.compile(searchTerm)
+	if err != nil {
+		e.screen.Echo(err.Error())
+		return
+	}
+	accept, ok := e.searchFilter(opts)
+	if !ok {
+		return
+	}
+	content, starts, err := e.Bytes()
+	if err != nil {
+		return
+	}
+	if opts.Regexp {
+		e.foundRegexp = re
+	}
+	content = content[:len(content)-1] // Without the EOF mark
+	for _, match := range re.FindAllSubmatchIndex(content, -1) {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			found := foundPosition{start: offsetToCursor(starts, match[0]), stop: offsetToCursor(starts, match[1])}
+			found.submatches = relativeSubmatches(match)
+			if accept(found) {
+				e.foundIndexes = append(e.foundIndexes, found)
+			}
+		}
+	}
+}
+
+// Filter of the matches by opts.WholeWord and opts.InRegion
+// ok is false if opts.InRegion and the mark is not set
+func (e *Editor) searchFilter(opts SearchOptions) (accept func(found foundPosition) bool, ok bool) {
+	var start, stop file.Cursor
+	if opts.InRegion {
+		if start, stop, ok = e.markRegion(); !ok {
+			return nil, false
+		}
+	}
+	return func(found foundPosition) bool {
+		if opts.InRegion && (found.start.Compare(start) < 0 || found.stop.Compare(stop) > 0) {
+			return false
+		}
+		return !opts.WholeWord || e.isWholeWord(found)
+	}, true
+}
+
+// Whether found is not joined to a word on either side
+func (e *Editor) isWholeWord(found foundPosition) bool {
+	rows := e.Rows()
+	if inWord(rows.Row(found.start.RowIndex).Bytes(), found.start.ColIndex) {
+		return false
+	}
+	return found.stop.RowIndex >= rows.Length() || !inWord(rows.Row(found.stop.RowIndex).Bytes(), found.stop.ColIndex)
+}
+
+// Whether colIndex of line is between two word runes
+func inWord(line []byte, colIndex int) bool {
+	if colIndex <= 0 || colIndex >= len(line) {
+		return false
+	}
+	before, _ := utf8.DecodeLastRune(line[:colIndex])
+	after, _ := utf8.DecodeRune(line[colIndex:])
+	return isWordRune(before) && isWordRune(after)
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Region between the mark and the cursor in order, active or not
+func (e *Editor) markRegion() (start, stop file.Cursor, ok bool) {
+	m := Marks.FindLastByPath(e.GetPath())
+	if m == nil {
+		e.screen.Echo("The mark is not set now, so there is no region")
+		return start, stop, false
+	}
+	start, stop = m.Cursor, e.Cursor
+	if start.Compare(stop) > 0 {
+		start, stop = stop, start
+	}
+	return start, stop, true
+}
+
+// Cursor of the offset in the rows joined by Bytes, starts holds the offset of each row
+// The offset right of a linefeed is the start of the next row
+func offsetToCursor(starts []int, offset int) file.Cursor {
+	rowIndex, found := slices.BinarySearch(starts, offset)
+	if !found {
+		rowIndex--
+	}
+	return file.Cursor{RowIndex: rowIndex, ColIndex: offset - starts[rowIndex]}
+}
+
+// Submatch indexes of match from the start of the match, unmatched groups stay -1
+func relativeSubmatches(match []int) []int {
+	submatches := make([]int, len(match))
+	for i, index := range match {
+		submatches[i] = index
+		if index >= 0 {
+			submatches[i] -= match[0]
+		}
+	}
+	return submatches
+}
+
+func (e *Editor) searchText(text string, opts SearchOptions, ctx context.Context) {
+	accept, ok := e.searchFilter(opts)
+	if !ok {
+		return
+	}
+	caseSensitive := opts.caseSensitive(text)
+	if !caseSensitive {
+		text = strings.ToLower(text)
+	}
+	textBytes := []byte(text)
+	textBytesLen := len(textBytes)
+
+	lines := e.Rows()
+	for i := 0; i < lines.Length(); i++ {
+		line := lines.Row(i).Bytes()
+		index := 0
+	loop:
+		for limit := 0; ; limit++ {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				substring := line[index:]
+				if !caseSensitive {
+					substring = bytes.ToLower(substring)
+				}
+				findIndex := bytes.Index(substring, textBytes)
+				if findIndex == -1 {
+					break loop
+				}
+				startIndex := len(line[:index+findIndex])
+				stopIndex := startIndex + textBytesLen
+				if found := newFoundPosition(i, startIndex, i, stopIndex); accept(found) {
+					e.foundIndexes = append(e.foundIndexes, found)
+				}
+				index += findIndex + textBytesLen
+			}
+
+			if limit > 100_000 {
+				e.screen.Echo("Search text over 100,000")
+				return
+			}
+		}
+	}
+}
+
+// Replace the current search result with str as one undo step
+// After a regular expression search, $1 and ${name} in str are expanded from the submatches
+func (e *Editor) ReplaceCurrentSearchString(str string) {
+	if e.currentSearchIndex == -1 {
 		return
 	}
 	foundPosition := e.foundIndexes[e.currentSearchIndex]
-	e.killRegion(file.Cursor{RowIndex: foundPosition.start.RowIndex, ColIndex: foundPosition.start.ColIndex},
-		file.Cursor{RowIndex: foundPosition.start.RowIndex, ColIndex: foundPosition.stop.ColIndex})
-	e.InsertString(str)
-
-	// Correct the changed indexes within the same line where replacement is made
-	// How many rune characters change due to replacement?
-	// l := utf8.RuneCountInString(str) - (foundPosition.endColIndex - foundPosition.startColIndex)
-	l := len([]byte(str)) - (foundPosition.stop.ColIndex - foundPosition.start.ColIndex)
-	// RowIndex where replacement is made
-	rowIndex := e.foundIndexes[e.currentSearchIndex].start.RowIndex
-	// Correct the changed indexes due to replacement within the same line
-	for i := e.currentSearchIndex + 1; i < len(e.foundIndexes) && e.foundIndexes[i].start.RowIndex == rowIndex; i++ {
-		e.foundIndexes[i].start.ColIndex += l
-		e.foundIndexes[i].stop.ColIndex += l
+	e.BeginUndoGroup()
+	matched := e.deleteRegion(foundPosition.start, foundPosition.stop)
+	replacement := []byte(str)
+	if e.foundRegexp != nil && foundPosition.submatches != nil {
+		replacement = e.foundRegexp.Expand(nil, replacement, matched, foundPosition.submatches)
 	}
+	e.insertBytes(replacement, true)
+	e.EndUndoGroup()
+
+	// The other search results follow the edit, see syncCursorAndBufferForEdit
 	// Exclude the replaced search result
 	// What if the replacement still matches the search after replacement? No consideration for now
 	e.foundIndexes = slices.Delete(e.foundIndexes, e.currentSearchIndex, e.currentSearchIndex+1)
 }
 
+// ------------------------------------------------------------------
+// Incremental search
+// ------------------------------------------------------------------
+
+// Text of the last incremental search, searched again by repeating an empty search
+var lastISearchText string
+
+// State of an incremental search, see ISearchForward
+type isearchState struct {
+	origin  file.Cursor // Cursor when the search started, restored by ISearchAbort
+	forward bool
+	steps   []isearchStep // Undone by ISearchBackspace, the last is the current state
+}
+
+type isearchStep struct {
+	text    string
+	re      *regexp.Regexp
+	match   foundPosition
+	found   bool
+	wrapped bool // The search went around the end of the buffer
+
+	counted      bool // index and total are counted, see isearchModeline
+	index, total int  // index is 0 if the match is after the counted part
+	capped       bool // Counting stopped before the end of the buffer, total is a lower bound
+}
+
+// Counting the matches stops at either limit so that large files stay responsive
+const (
+	isearchCountMatches = 1000
+	isearchCountBytes   = 4 << 20
+)
+
+// Start an incremental search forward, or move to the next match
+func (e *Editor) ISearchForward() {
+	e.isearchRepeat(true)
+}
+
+// Start an incremental search backward, or move to the previous match
+func (e *Editor) ISearchBackward() {
+	e.isearchRepeat(false)
+}
+
+// Add s to the search text and move to the nearest match from the current one
+func (e *Editor) ISearchAddString(s string) {
+	if e.isearch == nil {
+		return
+	}
+	top := e.isearchTop()
+	e.isearchStep(top.text+s, true, top.wrapped)
+}
+
+// Undo the last ISearchAddString or move, the cursor goes back where it was
+func (e *Editor) ISearchBackspace() {
+	if e.isearch == nil || len(e.isearch.steps) == 1 {
+		return
+	}
+	e.isearch.steps = e.isearch.steps[:len(e.isearch.steps)-1]
+	e.isearchMoveCursor()
+}
+
+// Finish the search at the current match, the start position is recorded in the jump list
+// All matches stay highlighted for MoveNextFoundWord
+func (e *Editor) ISearchExit() {
+	if e.isearch == nil {
+		return
+	}
+	is, top := e.isearch, e.isearchTop()
+	e.isearch = nil
+
+	e.foundIndexes = []foundPosition{}
+	e.currentSearchIndex = -1
+	if top.text == "" {
+		return
+	}
+	lastISearchText = top.text
+	JumpList.Push(mark.NewMark(e.GetPath(), is.origin, ""))
+	for rowIndex := 0; rowIndex < e.Rows().Length(); rowIndex++ {
+		for _, m := range top.re.FindAllIndex(e.rowText(rowIndex), -1) {
+			if top.found && rowIndex == top.match.start.RowIndex && m[0] == top.match.start.ColIndex {
+				e.currentSearchIndex = len(e.foundIndexes)
+			}
+			e.foundIndexes = append(e.foundIndexes, newFoundPosition(rowIndex, m[0], rowIndex, m[1]))
+		}
+	}
+}
+
+// Cancel the search and move the cursor back where the search started
+func (e *Editor) ISearchAbort() {
+	if e.isearch == nil {
+		return
+	}
+	e.Cursor = e.isearch.origin
+	e.isearch = nil
+	e.foundIndexes = []foundPosition{}
+	e.currentSearchIndex = -1
+	e.PrevCx = -1
+}
+
+// Prompt of the minibuffer, such as "Wrapped I-search: text"
+func (e *Editor) ISearchPrompt() string {
+	if e.isearch == nil {
+		return ""
+	}
+	top := e.isearchTop()
+	prompt := "I-search"
+	if !e.isearch.forward {
+		prompt += " backward"
+	}
+	if top.wrapped {
+		prompt = "Wrapped " + prompt
+	}
+	if !top.found && top.text != "" {
+		prompt = "Failing " + prompt
+	}
+	return prompt + ": " + top.text
+}
+
+func (e *Editor) isearchTop() isearchStep {
+	return e.isearch.steps[len(e.isearch.steps)-1]
+}
+
+// Start a search, or search the same text again in the direction
+func (e *Editor) isearchRepeat(forward bool) {
+	if e.isearch == nil {
+		e.isearch = &isearchState{origin: e.Cursor, forward: forward, steps: []isearchStep{{}}}
+		e.foundIndexes = []foundPosition{}
+		e.currentSearchIndex = -1
+		return
+	}
+	e.isearch.forward = forward
+	top := e.isearchTop()
+	if top.text == "" {
+		if lastISearchText != "" {
+			e.isearchStep(lastISearchText, true, false)
+		}
+		return
+	}
+	e.isearchStep(top.text, false, top.wrapped)
+}
+
+// Push a step searching text from the current match, which matches again if inclusive
+func (e *Editor) isearchStep(text string, inclusive, wrapped bool) {
+	re, _ := SearchOptions{Case: SmartCase}.compile(text) // A literal text always compiles
+	step := isearchStep{text: text, re: re, wrapped: wrapped}
+
+	from := e.Cursor
+	if top := e.isearchTop(); top.found {
+		from = top.match.start
+	}
+	var wrappedNow bool
+	step.match, step.found, wrappedNow = e.findNearest(step.re, from, e.isearch.forward, inclusive)
+	step.wrapped = step.wrapped || (step.found && wrappedNow)
+	e.isearch.steps = append(e.isearch.steps, step)
+	e.isearchMoveCursor()
+}
+
+// Move the cursor to the match of the current step, or where the search started if there is none
+func (e *Editor) isearchMoveCursor() {
+	top := e.isearchTop()
+	if top.found {
+		e.Cursor = top.match.start
+	} else if top.text == "" {
+		e.Cursor = e.isearch.origin
+	}
+	e.PrevCx = -1
+}
+
+// Nearest match of re from cursor in the direction, going around the end of the buffer
+// A match starting at cursor is found only if inclusive
+func (e *Editor) findNearest(re *regexp.Regexp, cursor file.Cursor, forward, inclusive bool) (match foundPosition, found, wrapped bool) {
+	rows := e.Rows()
+	n := rows.Length()
+	for i := 0; i <= n; i++ {
+		rowIndex := (cursor.RowIndex + i) % n
+		if !forward {
+			rowIndex = ((cursor.RowIndex-i)%n + n) % n
+		}
+		matches := re.FindAllIndex(e.rowText(rowIndex), -1)
+		if !forward {
+			slices.Reverse(matches)
+		}
+		for _, m := range matches {
+			if i == 0 || i == n {
+				// The cursor row is searched on both sides of the cursor
+				after := m[0] > cursor.ColIndex || (inclusive && m[0] == cursor.ColIndex)
+				if !forward {
+					after = m[0] < cursor.ColIndex || (inclusive && m[0] == cursor.ColIndex)
+				}
+				if after != (i == 0) {
+					continue
+				}
+			}
+			wrapped = i == n || (forward && rowIndex < cursor.RowIndex) || (!forward && rowIndex > cursor.RowIndex)
+			return newFoundPosition(rowIndex, m[0], rowIndex, m[1]), true, wrapped
+		}
+	}
+	return foundPosition{}, false, false
+}
+
+// Row without its linefeed or EOF mark, so that ^ and $ of a per-row match stay inside the row
+func (e *Editor) rowText(rowIndex int) []byte {
+	row := e.Rows().Row(rowIndex).Bytes()
+	return row[:len(row)-1]
+}
+
+// Highlight the matches in rows start to stop only, the rest of the buffer is not searched
+func (e *Editor) highlightISearch(start, stop int) {
+	top := e.isearchTop()
+	e.foundIndexes = e.foundIndexes[:0]
+	if top.text == "" {
+		return
+	}
+	for rowIndex := start; rowIndex < min(stop, e.Rows().Length()); rowIndex++ {
+		for _, m := range top.re.FindAllIndex(e.rowText(rowIndex), -1) {
+			e.foundIndexes = append(e.foundIndexes, newFoundPosition(rowIndex, m[0], rowIndex, m[1]))
+		}
+	}
+}
+
+// Match counter for the modeline, such as "I-search 3/41"
+func (e *Editor) isearchModeline() string {
+	// Counted once for each step, the buffer does not change during the search
+	top := &e.isearch.steps[len(e.isearch.steps)-1]
+	s := "I-search"
+	if top.wrapped {
+		s = "Wrapped " + s
+	}
+	if top.text == "" {
+		return s
+	}
+	if !top.counted {
+		scanned := 0
+	count:
+		for rowIndex := 0; rowIndex < e.Rows().Length(); rowIndex++ {
+			if top.total >= isearchCountMatches || scanned >= isearchCountBytes {
+				top.capped = true
+				break
+			}
+			row := e.rowText(rowIndex)
+			scanned += len(row)
+			for _, m := range top.re.FindAllIndex(row, -1) {
+				if top.total >= isearchCountMatches {
+					top.capped = true
+					break count
+				}
+				top.total++
+				if top.found && rowIndex == top.match.start.RowIndex && m[0] == top.match.start.ColIndex {
+					top.index = top.total
+				}
+			}
+		}
+		top.counted = true
+	}
+	if !top.capped {
+		return fmt.Sprintf("%s %d/%d", s, top.index, top.total)
+	}
+	if top.index == 0 && top.found {
+		return fmt.Sprintf("%s ?/%d+", s, top.total)
+	}
+	return fmt.Sprintf("%s %d/%d+", s, top.index, top.total)
+}
+
+// ------------------------------------------------------------------
+// Query replace
+// ------------------------------------------------------------------
+
+// State of a query replace, see QueryReplace
+type queryReplaceState struct {
+	replacer
+	search    string
+	wholeWord bool            // Only whole words match, see isWholeWord
+	stop      file.Cursor     // End of the text to replace in, follows the edits
+	file      *file.File      // Buffer replaced in, switching to another one finishes the query replace
+	origin    file.Cursor     // Cursor at the start, undo of the replacements moves back to it
+	undo      *file.EditGroup // Undo step of the replacements, extended by each one
+	match     foundPosition
+	history   []queryReplaceStep // Matches answered, undone by QueryReplaceBack
+	replaced  int
+}
+
+// Match answered by QueryReplaceYes or QueryReplaceNo
+type queryReplaceStep struct {
+	start, stop file.Cursor // Range of the replacement, of the match if skipped
+	original    []byte      // Text of the match, nil if skipped
+}
+
+// Replace matches of search in the region, or from the cursor to the end of the buffer, asking at each one
+// Answer by QueryReplaceYes (y), QueryReplaceNo (n), QueryReplaceAll (!), QueryReplaceQuit (q) and QueryReplaceBack (^)
+// The whole session is one undo step
+//
+// The region is the active one, or the one between the mark and the cursor if opts.InRegion.
+// If opts.Regexp, $1 and ${name} in replacement are expanded from the submatches.
+// If the search ignores case and replacement has no upper case letter, it follows the case of each match.
+// A match does not span rows, opts.Multiline is ignored
+func (e *Editor) QueryReplace(search, replacement string, opts SearchOptions) {
+	if e.queryReplace != nil || e.isearch != nil {
+		return
+	}
+	if start, stop, ok := e.replaceScope(e.Cursor, opts); ok {
+		e.startQueryReplace(search, replacement, opts, start, stop)
+	}
+}
+
+// Replace all matches of search in the region, or in the buffer, as one undo step
+// The arguments are those of QueryReplace
+func (e *Editor) ReplaceAll(search, replacement string, opts SearchOptions) {
+	if e.queryReplace != nil || e.isearch != nil {
+		return
+	}
+	start, stop, ok := e.replaceScope(file.Cursor{}, opts)
+	if ok && e.startQueryReplace(search, replacement, opts, start, stop) {
+		e.QueryReplaceAll()
+	}
+}
+
+// Replace the current match and move to the next one
+func (e *Editor) QueryReplaceYes() {
+	if e.queryReplace == nil {
+		return
+	}
+	e.queryReplaceAnswer(true)
+}
+
+// Skip the current match and move to the next one
+func (e *Editor) QueryReplaceNo() {
+	if e.queryReplace == nil {
+		return
+	}
+	e.queryReplaceAnswer(false)
+}
+
+// Replace the current match and all the following ones without asking
+func (e *Editor) QueryReplaceAll() {
+	for e.queryReplace != nil {
+		e.queryReplaceAnswer(true)
+	}
+}
+
+// Finish the query replace, the replacements so far are kept
+func (e *Editor) QueryReplaceQuit() {
+	if e.queryReplace == nil {
+		return
+	}
+	e.finishQueryReplace()
+}
+
+// Go back to the previous match, its replacement is reverted to answer again
+func (e *Editor) QueryReplaceBack() {
+	qr := e.queryReplace
+	if qr == nil {
+		return
+	}
+	if len(qr.history) == 0 {
+		e.screen.Echo("No previous match")
+		return
+	}
+	step := qr.history[len(qr.history)-1]
+	qr.history = qr.history[:len(qr.history)-1]
+	if step.original != nil {
+		e.queryReplaceEdit(step.start, step.stop, step.original)
+		qr.replaced--
+	}
+	e.queryReplaceFind(step.start, true)
+}
+
+// Prompt of the minibuffer, such as "Query replacing foo with bar (y, n, !, q, ^): 2 replaced"
+func (e *Editor) QueryReplacePrompt() string {
+	qr := e.queryReplace
+	if qr == nil {
+		return ""
+	}
+	return fmt.Sprintf("Query replacing %s with %s (y, n, !, q, ^): %d replaced", qr.search, qr.replacement, qr.replaced)
+}
+
+// Text to replace in, the region or from start to the end of the buffer
+func (e *Editor) replaceScope(start file.Cursor, opts SearchOptions) (file.Cursor, file.Cursor, bool) {
+	if r := e.activeRegion(); r.active {
+		e.DeactivateMark()
+		return r.start, r.stop, true
+	}
+	if opts.InRegion {
+		return e.markRegion()
+	}
+	return start, e.endOfBuffer(), true
+}
+
+// Move to the first match from start
+// Returns false if search is not a valid regular expression or there is no match
+func (e *Editor) startQueryReplace(search, replacement string, opts SearchOptions, start, stop file.Cursor) bool {
+	re, err := opts.compile(search)
+	if err != nil {
+		e.screen.Echo(err.Error())
+		return false
+	}
+
+	e.recordJump()
+	e.queryReplace = &queryReplaceState{
+		replacer:  newReplacer(re, search, replacement, opts),
+		search:    search,
+		wholeWord: opts.WholeWord,
+		stop:      stop,
+		file:      e.File,
+		origin:    e.Cursor,
+	}
+	e.queryReplaceFind(start, true)
+	return e.queryReplace != nil
+}
+
+// Replace the current match if replace, and move to the next one
+func (e *Editor) queryReplaceAnswer(replace bool) {
+	qr := e.queryReplace
+	step := queryReplaceStep{start: qr.match.start, stop: qr.match.stop}
+	if replace {
+		matched := e.Rows().Row(qr.match.start.RowIndex).Bytes()[qr.match.start.ColIndex:]
+		data := qr.replace(matched, qr.match.submatches)
+		step.original, step.stop = e.queryReplaceEdit(qr.match.start, qr.match.stop, data)
+		qr.replaced++
+	}
+	qr.history = append(qr.history, step)
+	// An empty match is not matched again where it was
+	e.queryReplaceFind(step.stop, !qr.match.start.Equals(qr.match.stop))
+}
+
+// Replace start to stop with data, returns the replaced text and the end of data
+// The end of the text to replace in follows the edit
+// The edit joins the undo step of the previous ones, no undo group is left open between the answers
+func (e *Editor) queryReplaceEdit(start, stop file.Cursor, data []byte) ([]byte, file.Cursor) {
+	qr := e.queryReplace
+	var original []byte
+	actions := e.UndoAction.Record(func() {
+		original = slices.Clone(e.deleteRegion(start, stop))
+		qr.stop.AdjustForDeletion(start, stop)
+		e.insertBytes(data, true)
+		qr.stop.AdjustForInsertion(start, e.Cursor)
+	})
+	qr.undo = e.UndoAction.ExtendGroup(qr.undo, qr.origin, actions)
+	return original, e.Cursor
+}
+
+// Move to the first match from cursor, the query replace finishes if there is none before its end
+// An empty match at cursor is skipped unless empty is true
+func (e *Editor) queryReplaceFind(cursor file.Cursor, empty bool) {
+	qr := e.queryReplace
+	rows := e.Rows()
+	for rowIndex := cursor.RowIndex; rowIndex <= qr.stop.RowIndex && rowIndex < rows.Length(); rowIndex++ {
+		for _, m := range qr.re.FindAllSubmatchIndex(e.rowText(rowIndex), -1) {
+			if rowIndex == cursor.RowIndex && (m[0] < cursor.ColIndex || (m[0] == cursor.ColIndex && m[0] == m[1] && !empty)) {
+				continue
+			}
+			if rowIndex == qr.stop.RowIndex && m[1] > qr.stop.ColIndex {
+				break
+			}
+			match := newFoundPosition(rowIndex, m[0], rowIndex, m[1])
+			match.submatches = relativeSubmatches(m)
+			if qr.wholeWord && !e.isWholeWord(match) {
+				continue
+			}
+			qr.match = match
+
+			e.Cursor = qr.match.start
+			e.PrevCx = -1
+			e.foundIndexes = []foundPosition{qr.match}
+			e.currentSearchIndex = 0
+			return
+		}
+	}
+	e.finishQueryReplace()
+}
+
+func (e *Editor) finishQueryReplace() {
+	qr := e.queryReplace
+	e.queryReplace = nil
+	e.foundIndexes = []foundPosition{}
+	e.currentSearchIndex = -1
+	e.screen.Echo(fmt.Sprintf("Replaced %d occurrences", qr.replaced))
+}
+
+// Cursor left of the EOF mark
+func (e *Editor) endOfBuffer() file.Cursor {
+	last := e.Rows().Length() - 1
+	return file.Cursor{RowIndex: last, ColIndex: e.Rows().Row(last).Length() - 1}
+}
+
+// Replacement of the matches of a search, shared by QueryReplace and ReplaceInFiles
+type replacer struct {
+	re           *regexp.Regexp
+	replacement  string
+	expand       bool // Expand $1 and ${name} in replacement
+	preserveCase bool // Replacement follows the case of the match, see matchCase
+}
+
+// If opts.Regexp, replacement is expanded from the submatches of re
+// If search ignores case and replacement has no upper case letter, it follows the case of each match
+func newReplacer(re *regexp.Regexp, search, replacement string, opts SearchOptions) replacer {
+	return replacer{
+		re:           re,
+		replacement:  replacement,
+		expand:       opts.Regexp,
+		preserveCase: !opts.caseSensitive(search) && !hasUpper(replacement, false),
+	}
+}
+
+// Replacement of the match at the start of matched, submatches are relative to it
+func (r replacer) replace(matched []byte, submatches []int) []byte {
+	data := []byte(r.replacement)
+	if r.expand {
+		data = r.re.Expand(nil, data, matched, submatches)
+	}
+	if r.preserveCase {
+		data = matchCase(data, matched[:submatches[1]])
+	}
+	return data
+}
+
+// Line with all the matches of match replaced
+func (r replacer) replaceAll(line []byte, match grep.Matcher) []byte {
+	var result []byte
+	last := 0
+	for _, m := range match(line) {
+		result = append(append(result, line[last:m[0]]...), r.replace(line[m[0]:], relativeSubmatches(m))...)
+		last = m[1]
+	}
+	return append(result, line[last:]...)
+}
+
+// Case of replacement following matched, as "bar" replacing "foo", "Foo" and "FOO" gives "bar", "Bar" and "BAR"
+// A match of mixed case leaves replacement as it is
+func matchCase(replacement, matched []byte) []byte {
+	upper, lower := 0, 0
+	firstUpper := false
+	for _, r := range string(matched) {
+		if unicode.IsUpper(r) {
+			if upper+lower == 0 {
+				firstUpper = true
+			}
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+	}
+	if upper > 1 && lower == 0 {
+		return bytes.ToUpper(replacement)
+	}
+	if !firstUpper {
+		return replacement
+	}
+	// Capitalize the first letter
+	for i, r := range string(replacement) {
+		if unicode.IsLetter(r) {
+			return slices.Concat(replacement[:i], utf8.AppendRune(nil, unicode.ToUpper(r)), replacement[i+utf8.RuneLen(r):])
+		}
+	}
+	return replacement
+}
+
+// ------------------------------------------------------------------
+// Grep
+// ------------------------------------------------------------------
+
+// Result lines of Grep longer than this are cut
+const maxGrepLineLength = 500
+
+// Last Grep, its *grep* buffer is replaced by the next one
+var grepSearch *grepState
+
+type grepState struct {
+	file      *file.File // *grep* buffer
+	dir       string
+	cancel    context.CancelFunc
+	locations map[int]grepLocation // Location of the result on each row of the buffer
+	lines     int
+	files     int
+	finished  bool // The summary is in the buffer
+
+	mutex   sync.Mutex // Guards the fields below, written by the search goroutines
+	pending []grep.Result
+	done    bool
+	err     error
+}
+
+type grepLocation struct {
+	path   string
+	cursor file.Cursor
+}
+
+// Search text with opts in the files under dir, the files ignored by .gitignore are skipped
+// The results show up in a read-only *grep* buffer as they are found, GrepJump opens the file of a result
+// Cancel ctx to stop the search, opts.InRegion and opts.Multiline are ignored
+func (e *Editor) Grep(ctx context.Context, dir, text string, opts SearchOptions) {
+	if text == "" {
+		return
+	}
+	opts.Multiline = false
+	re, err := opts.compile(text)
+	if err != nil {
+		e.screen.Echo(err.Error())
+		return
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		e.screen.Echo(err.Error())
+		return
+	}
+	match := grepMatcher(re, opts.WholeWord)
+
+	if grepSearch != nil {
+		grepSearch.cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	gs := &grepState{dir: dir, cancel: cancel, locations: map[int]grepLocation{}}
+	grepSearch = gs
+	e.recordJump()
+	gs.file, e.Meta = BufferSets.GetScratchFileAndMeta("*grep*", fmt.Appendf(nil, "Grep %q in %s\n", text, dir))
+	e.File = gs.file
+	e.bsArray.ClearAll()
+	e.specialCharWidths = nil
+
+	// The event loop puts the results into the buffer, see flushGrep
+	wake := func() { e.screen.PostEvent(tcell.NewEventInterrupt(nil)) }
+	go func() {
+		err := grep.Search(ctx, dir, match, func(results []grep.Result) {
+			gs.mutex.Lock()
+			first := len(gs.pending) == 0
+			gs.pending = append(gs.pending, results...)
+			gs.mutex.Unlock()
+			if first {
+				wake()
+			}
+		})
+		gs.mutex.Lock()
+		gs.done, gs.err = true, err
+		gs.mutex.Unlock()
+		wake()
+	}()
+}
+
+// Matches of re in a line with their submatches, only whole words if wholeWord
+func grepMatcher(re *regexp.Regexp, wholeWord bool) grep.Matcher {
+	return func(line []byte) [][]int {
+		matches := re.FindAllSubmatchIndex(line, -1)
+		if wholeWord {
+			matches = slices.DeleteFunc(matches, func(m []int) bool { return inWord(line, m[0]) || inWord(line, m[1]) })
+		}
+		return matches
+	}
+}
+
+// Open the file of the result on the cursor row of the *grep* buffer at the match
+func (e *Editor) GrepJump() {
+	gs := grepSearch
+	if gs == nil || e.File != gs.file {
+		e.screen.Echo("Not in the *grep* buffer")
+		return
+	}
+	location, ok := gs.locations[e.RowIndex]
+	if !ok {
+		e.screen.Echo("No grep result on this line")
+		return
+	}
+	e.recordJump()
+	e.jumpToMark(mark.NewMark(location.path, location.cursor, ""))
+}
+
+// Put the results found since the last call into the *grep* buffer, and the summary when the search is done
+// Called from the event loop, the search goroutines only add to pending
+func flushGrep() {
+	gs := grepSearch
+	if gs == nil || gs.finished {
+		return
+	}
+	gs.mutex.Lock()
+	pending, done, err := gs.pending, gs.done, gs.err
+	gs.pending = nil
+	gs.mutex.Unlock()
+
+	rowIndex := gs.file.Rows().Length() - 1 // Row of the EOF mark
+	lines := [][]byte{}
+	lastPath := ""
+	for _, r := range pending {
+		if r.Path != lastPath {
+			gs.files++
+			lastPath = r.Path
+		}
+		gs.lines++
+		gs.locations[rowIndex+len(lines)] = grepLocation{path: r.Path, cursor: file.Cursor{RowIndex: r.RowIndex, ColIndex: r.Matches[0][0]}}
+		path, _ := filepath.Rel(gs.dir, r.Path)
+		lines = append(lines, fmt.Appendf(nil, "%s:%d:%d: %s\n", path, r.RowIndex+1, r.Matches[0][0]+1, cutLine(r.Line, maxGrepLineLength)))
+	}
+	if done {
+		gs.finished = true
+		summary := fmt.Sprintf("Grep finished, %d lines in %d files", gs.lines, gs.files)
+		if errors.Is(err, context.Canceled) {
+			summary = fmt.Sprintf("Grep canceled, %d lines in %d files", gs.lines, gs.files)
+		} else if err != nil {
+			summary = "Grep failed, " + err.Error()
+		}
+		lines = append(lines, []byte("\n"), []byte(summary+"\n"))
+	}
+	appendRows(gs.file, lines)
+}
+
+// Insert lines before the EOF mark of ff without undo, the editors showing ff follow
+func appendRows(ff *file.File, lines [][]byte) {
+	if len(lines) == 0 {
+		return
+	}
+	rows := ff.Rows()
+	rowIndex := rows.Length() - 1
+	for i, line := range lines {
+		rows.InsertRow(rowIndex+i, line)
+	}
+	for _, leaf := range tree.GetLeavesByViewName("editorview") {
+		if editor := (*leaf).(*Editor); editor.File == ff {
+			editor.bsArray.Insert(rowIndex, len(lines))
+		}
+	}
+}
+
+// Cut line to at most n bytes on a rune boundary, followed by "..." if cut
+func cutLine(line []byte, n int) []byte {
+	if len(line) <= n {
+		return line
+	}
+	for n > 0 && !utf8.RuneStart(line[n]) {
+		n--
+	}
+	return append(line[:n:n], "..."...)
+}
+
+// ------------------------------------------------------------------
+// Replace in files
+// ------------------------------------------------------------------
+
+// Context lines around the changes in the preview, nearer changes are one hunk
+const replaceInFilesContext = 2
+
+// Last ReplaceInFiles, its *replace* buffer is replaced by the next one
+var replaceInFiles *replaceInFilesState
+
+type replaceInFilesState struct {
+	file     *file.File // *replace* buffer
+	screen   *screen.Screen
+	dir      string
+	cancel   context.CancelFunc
+	files    []*replaceFile
+	owners   map[int]replaceOwner // File and hunk of each row of the buffer
+	finished bool                 // The preview is in the buffer
+	applied  bool
+
+	mutex     sync.Mutex // Guards the fields below, written by the collecting goroutine
+	collected []*replaceFile
+	done      bool
+	err       error
+}
+
+// Changes of a file and the hunks selected to apply
+type replaceFile struct {
+	path     string
+	hunks    []diff.Hunk
+	selected []bool
+	row      int   // Row of the file line in the *replace* buffer
+	hunkRows []int // Row of the range line of each hunk
+}
+
+type replaceOwner struct {
+	file *replaceFile
+	hunk int // -1 on the file line
+}
+
+// Content of an open buffer, the collecting goroutine reads it instead of the file
+type replaceSnapshot struct {
+	path    string
+	content []byte
+}
+
+// Replace search with replacement in the files under dir, the files ignored by .gitignore are skipped
+// The changes are collected in the background and previewed as hunks in a read-only *replace* buffer, all selected
+// Deselect hunks with ReplaceInFilesToggle and apply the others with ReplaceInFilesApply
+// Cancel ctx to stop collecting
+//
+// The buffers of the files already open are changed as they are, with their modifications.
+// The replacement is that of QueryReplace, opts.InRegion and opts.Multiline are ignored
+func (e *Editor) ReplaceInFiles(ctx context.Context, dir, search, replacement string, opts SearchOptions) {
+	if search == "" {
+		return
+	}
+	opts.Multiline = false
+	re, err := opts.compile(search)
+	if err != nil {
+		e.screen.Echo(err.Error())
+		return
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		e.screen.Echo(err.Error())
+		return
+	}
+
+	// The buffers are edited on the event loop, the goroutine reads copies of them
+	snapshots := []replaceSnapshot{}
+	paths := []string{}
+	for _, bs := range *BufferSets {
+		if bs.IsScratch() {
+			continue
+		}
+		content, _, err := bs.Bytes()
+		if err != nil || len(content) == 0 {
+			continue
+		}
+		snapshots = append(snapshots, replaceSnapshot{path: bs.GetPath(), content: content[:len(content)-1]}) // Without the EOF mark
+		// The matches of a modified buffer may not be in its file yet, it is skipped as its file would be
+		if path, err := filepath.Abs(bs.GetPath()); err == nil && bs.IsDirtyFlag() && strings.HasPrefix(path, dir+string(filepath.Separator)) && !grep.Ignored(dir, path) {
+			paths = append(paths, path)
+		}
+	}
+
+	if replaceInFiles != nil {
+		replaceInFiles.cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	rs := &replaceInFilesState{screen: e.screen, dir: dir, cancel: cancel, owners: map[int]replaceOwner{}}
+	replaceInFiles = rs
+	e.recordJump()
+	rs.file, e.Meta = BufferSets.GetScratchFileAndMeta("*replace*", fmt.Appendf(nil, "Replace %q with %q in %s\n", search, replacement, dir))
+	e.File = rs.file
+	e.bsArray.ClearAll()
+	e.specialCharWidths = nil
+
+	// The event loop puts the preview into the buffer, see flushReplaceInFiles
+	match, r := grepMatcher(re, opts.WholeWord), newReplacer(re, search, replacement, opts)
+	go func() {
+		files, err := collectReplacements(ctx, dir, match, r, snapshots, paths)
+		rs.mutex.Lock()
+		rs.collected, rs.done, rs.err = files, true, err
+		rs.mutex.Unlock()
+		rs.screen.PostEvent(tcell.NewEventInterrupt(nil))
+	}()
+}
+
+// Changes of the files under dir with a match and of paths, in the order of their paths
+func collectReplacements(ctx context.Context, dir string, match grep.Matcher, r replacer, snapshots []replaceSnapshot, paths []string) ([]*replaceFile, error) {
+	err := grep.Search(ctx, dir, match, func(results []grep.Result) {
+		paths = append(paths, results[0].Path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(paths)
+	paths = slices.Compact(paths)
+
+	files := []*replaceFile{}
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		data, err := replaceSource(path, snapshots)
+		if err != nil {
+			continue
+		}
+		old := diffLines(data)
+		new := make([]string, 0, len(old))
+		for _, line := range old {
+			new = append(new, strings.Split(string(r.replaceAll([]byte(line), match)), "\n")...) // A replacement may have linefeeds
+		}
+		rf := &replaceFile{path: path, hunks: diff.Lines(old, new, replaceInFilesContext)}
+		if len(rf.hunks) == 0 {
+			continue
+		}
+		rf.selected = make([]bool, len(rf.hunks))
+		for i := range rf.selected {
+			rf.selected[i] = true
+		}
+		files = append(files, rf)
+	}
+	return files, nil
+}
+
+// Put the preview into the *replace* buffer when the changes are collected
+// Called from the event loop, the collecting goroutine only sets collected
+func flushReplaceInFiles() {
+	rs := replaceInFiles
+	if rs == nil || rs.finished {
+		return
+	}
+	rs.mutex.Lock()
+	files, done, err := rs.collected, rs.done, rs.err
+	rs.mutex.Unlock()
+	if !done {
+		return
+	}
+	rs.finished = true
+	rs.files = files
+
+	hunks := 0
+	for _, rf := range files {
+		hunks += len(rf.hunks)
+	}
+	summary := fmt.Sprintf("%d hunks in %d files (ReplaceInFilesToggle, ReplaceInFilesApply)", hunks, len(files))
+	if errors.Is(err, context.Canceled) {
+		summary = "Replace in files canceled"
+	} else if err != nil {
+		summary = "Replace in files failed, " + err.Error()
+	} else if len(files) == 0 {
+		summary = "No match in " + rs.dir
+	}
+	lines := rs.render(rs.file.Rows().Length() - 1) // From the row of the EOF mark
+	if len(files) == 0 {
+		lines = append(lines, []byte("\n"), []byte(summary+"\n"))
+	}
+	appendRows(rs.file, lines)
+	rs.screen.Echo(summary)
+}
+
+// Select or deselect the hunk on the cursor row of the *replace* buffer
+// On the line of a file, all its hunks are deselected if all are selected, selected otherwise
+func (e *Editor) ReplaceInFilesToggle() {
+	rs := replaceInFiles
+	if rs == nil || e.File != rs.file {
+		e.screen.Echo("Not in the *replace* buffer")
+		return
+	}
+	if rs.applied {
+		e.screen.Echo("Already applied")
+		return
+	}
+	owner, ok := rs.owners[e.RowIndex]
+	if !ok {
+		e.screen.Echo("No file or hunk on this line")
+		return
+	}
+	rf := owner.file
+	if owner.hunk < 0 {
+		all := !slices.Contains(rf.selected, false)
+		for i := range rf.selected {
+			rf.selected[i] = !all
+		}
+	} else {
+		rf.selected[owner.hunk] = !rf.selected[owner.hunk]
+	}
+	// The marks keep their width, the rows are replaced as they are
+	rows := rs.file.Rows()
+	rows.SetRow(rf.row, rs.fileLine(rf))
+	for i, rowIndex := range rf.hunkRows {
+		rows.SetRow(rowIndex, hunkLine(rf.hunks[i], rf.selected[i]))
+	}
+}
+
+// Apply the selected hunks of the last ReplaceInFiles, each file is opened as a buffer
+// The changes of a file are one undo step, the file is saved if save, left modified otherwise
+// A file whose lines changed since the preview is skipped
+func (e *Editor) ReplaceInFilesApply(save bool) {
+	rs := replaceInFiles
+	if rs == nil {
+		e.screen.Echo("No replace in files to apply")
+		return
+	}
+	if !rs.finished {
+		e.screen.Echo("Still collecting the changes")
+		return
+	}
+	if rs.applied {
+		e.screen.Echo("Already applied")
+		return
+	}
+	rs.applied = true
+
+	files, hunks := 0, 0
+	skipped, failed := []string{}, []string{}
+	for _, rf := range rs.files {
+		selected := []diff.Hunk{}
+		for i, h := range rf.hunks {
+			if rf.selected[i] {
+				selected = append(selected, h)
+			}
+		}
+		if len(selected) == 0 {
+			continue
+		}
+
+		ff, meta, err := BufferSets.GetFileAndMeta(rf.path)
+		if errors.Is(err, pkg_error.ErrorNewFile) {
+			BufferSets.RemoveByBufferFile(ff) // Not the empty buffer created for it
+			failed = append(failed, rs.rel(rf.path)+" no longer exists")
+			continue
+		} else if err != nil && !errors.Is(err, pkg_error.ErrorLoadedFile) {
+			failed = append(failed, rs.rel(rf.path)+" "+err.Error())
+			continue
+		}
+		e.onBuffer(ff, meta, func() {
+			if !e.applyHunks(selected) {
+				skipped = append(skipped, rs.rel(rf.path))
+				return
+			}
+			files++
+			hunks += len(selected)
+			if save {
+				if message, ok := e.saveBuffer(false); !ok {
+					failed = append(failed, message)
+				}
+			}
+		})
+		BufferSets.BufferSet(ff).PushMeta(meta)
+	}
+
+	message := fmt.Sprintf("Replaced %d hunks in %d files", hunks, files)
+	if !save {
+		message += ", not saved"
+	}
+	if len(skipped) > 0 {
+		message += ", changed since the preview: " + strings.Join(skipped, " ")
+	}
+	if len(failed) > 0 {
+		message += ", failed: " + strings.Join(failed, "; ")
+	}
+	e.screen.Echo(message)
+}
+
+// Run f with the editor on the buffer ff, then on its own buffer again
+// The edits of f are synchronized to the other editors of ff as those of any editor
+func (e *Editor) onBuffer(ff *file.File, meta *buffer.Meta, f func()) {
+	prevFile, prevMeta, prevFound := e.File, e.Meta, e.foundIndexes
+	e.File, e.Meta, e.foundIndexes = ff, meta, nil
+	e.bsArray.ClearAll()
+	e.specialCharWidths = nil
+	defer func() {
+		e.File, e.Meta, e.foundIndexes = prevFile, prevMeta, prevFound
+		e.bsArray.ClearAll()
+		e.specialCharWidths = nil
+	}()
+	f()
+}
+
+// Content of the buffer of path if it is open, of the file decoded as the buffer would load it otherwise
+func replaceSource(path string, snapshots []replaceSnapshot) ([]byte, error) {
+	for _, snapshot := range snapshots {
+		if utils.SameFile(path, snapshot.path) {
+			return snapshot.content, nil
+		}
+	}
+	return file.ReadDecoded(path)
+}
+
+// Rows of the preview from rowIndex, the rows of the files and hunks are recorded
+func (rs *replaceInFilesState) render(rowIndex int) [][]byte {
+	lines := [][]byte{}
+	line := func(owner replaceOwner, b []byte) {
+		if owner.file != nil {
+			rs.owners[rowIndex+len(lines)] = owner
+		}
+		lines = append(lines, b)
+	}
+	for _, rf := range rs.files {
+		line(replaceOwner{}, []byte("\n"))
+		rf.row = rowIndex + len(lines)
+		line(replaceOwner{file: rf, hunk: -1}, rs.fileLine(rf))
+		rf.hunkRows = make([]int, len(rf.hunks))
+		for i, h := range rf.hunks {
+			rf.hunkRows[i] = rowIndex + len(lines)
+			line(replaceOwner{file: rf, hunk: i}, hunkLine(h, rf.selected[i]))
+			for _, l := range h.Lines {
+				line(replaceOwner{file: rf, hunk: i}, fmt.Appendf(nil, "      %c%s\n", " -+"[l.Kind], cutLine([]byte(l.Text), maxGrepLineLength)))
+			}
+		}
+	}
+	return lines
+}
+
+// Line of a file, such as "[x] dir/a.go", "[-]" if some of its hunks are selected
+func (rs *replaceInFilesState) fileLine(rf *replaceFile) []byte {
+	box := "[-]"
+	if !slices.Contains(rf.selected, false) {
+		box = "[x]"
+	} else if !slices.Contains(rf.selected, true) {
+		box = "[ ]"
+	}
+	return fmt.Appendf(nil, "%s %s\n", box, rs.rel(rf.path))
+}
+
+// Path relative to the directory searched
+func (rs *replaceInFilesState) rel(path string) string {
+	if rel, err := filepath.Rel(rs.dir, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// Range line of a hunk, such as "  [x] @@ -1,3 +1,3 @@"
+func hunkLine(h diff.Hunk, selected bool) []byte {
+	box := "[ ]"
+	if selected {
+		box = "[x]"
+	}
+	return fmt.Appendf(nil, "  %s %s\n", box, h.Header())
+}
+
+// Apply hunks of a diff of the lines of the buffer as one undo step
+// Returns false without a change if the lines they change are not those of the buffer
+func (e *Editor) applyHunks(hunks []diff.Hunk) bool {
+	olds, news := make([]string, len(hunks)), make([]string, len(hunks))
+	for i, h := range hunks {
+		old, new := []string{}, []string{}
+		for _, l := range h.Lines {
+			if l.Kind != diff.INSERT {
+				old = append(old, l.Text)
+			}
+			if l.Kind != diff.DELETE {
+				new = append(new, l.Text)
+			}
+		}
+		if !e.hasLines(h.OldStart, old) {
+			return false
+		}
+		olds[i], news[i] = strings.Join(old, "\n"), strings.Join(new, "\n")
+	}
+
+	defer e.undoGroup()()
+	// From the last hunk, the rows of the previous ones stay
+	for i := len(hunks) - 1; i >= 0; i-- {
+		e.replaceText(file.Cursor{RowIndex: hunks[i].OldStart}, olds[i], news[i])
+	}
+	return true
+}
+
+// Whether the rows from rowIndex are lines
+func (e *Editor) hasLines(rowIndex int, lines []string) bool {
+	rows := e.Rows()
+	if rowIndex+len(lines) > rows.Length() {
+		return false
+	}
+	for i, line := range lines {
+		row := rows.Row(rowIndex + i).Bytes()
+		if string(row[:len(row)-1]) != line { // Without the linefeed or the EOF mark
+			return false
+		}
+	}
+	return true
+}
+
+// Replace old at start with new, only the text between their common prefix and suffix is edited
+func (e *Editor) replaceText(start file.Cursor, old, new string) {
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix] == new[prefix] {
+		prefix++
+	}
+	for prefix > 0 && prefix < len(old) && !utf8.RuneStart(old[prefix]) {
+		prefix--
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix && old[len(old)-1-suffix] == new[len(new)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !utf8.RuneStart(old[len(old)-suffix]) {
+		suffix--
+	}
+
+	from := file.EndCursor(start, []byte(old[:prefix]))
+	to := file.EndCursor(start, []byte(old[:len(old)-suffix]))
+	if from.Equals(to) {
+		e.Cursor = from
+	} else {
+		e.deleteRegion(from, to)
+	}
+	if data := new[prefix : len(new)-suffix]; data != "" {
+		e.insertBytes([]byte(data), true)
+	}
+}
+
 // ------------------------------------------------------------------
 // Other
 // ------------------------------------------------------------------
 
 func (e *Editor) CharInfo() {
-	ch, _ := utf8.DecodeRune((*e.Rows())[e.RowIndex][e.ColIndex:])
+	ch, _ := utf8.DecodeRune(e.Rows().Row(e.RowIndex).Bytes()[e.ColIndex:])
 	str := e.runeToDisplayStringForModeline(ch)
 	s := fmt.Sprintf("Char: '%s' (dec: %d, oct: %s, hex: %02X, %s), Cursor index: %d,%d", str, ch, strconv.FormatInt(int64(ch), 8), ch, utils.WidthKindString(ch), e.RowIndex, e.ColIndex)
 	e.screen.Echo(s)
@@ -1257,13 +3660,17 @@ func (e *Editor) insertBytes(bytes []byte, enableUndo bool) {
 		if b[bLen-1] == '\n' {
 			// verb.PP("1 b '%s' %d+%d", string(b), e.ColIndex, bLen)
 			// 新しい行を追加
-			lines.InsertRow(e.RowIndex+1, (*lines)[e.RowIndex][e.ColIndex:])
+			line := lines.Row(e.RowIndex).Bytes()
+			lines.InsertRow(e.RowIndex+1, line[e.ColIndex:])
+			// The linefeed of the row moves to the new row, the split row gets the default one
+			lines.SetTerminator(e.RowIndex+1, lines.Terminator(e.RowIndex))
+			lines.SetTerminator(e.RowIndex, 0)
 			// 現在の行にバイトスライスを追加
 			lines.SetRow(e.RowIndex,
 				append(
 					append(
 						make([]byte, 0, e.ColIndex+bLen),
-						(*lines)[e.RowIndex][:e.ColIndex]...),
+						line[:e.ColIndex]...),
 					b...))
 
 			//e.makeAvailableBoundariesArray(e.RowIndex) // -------- !
@@ -1275,7 +3682,7 @@ func (e *Editor) insertBytes(bytes []byte, enableUndo bool) {
 			e.Cx = 0
 		} else {
 			//verb.PP("b '%s' %d+%d", string(b), e.ColIndex, bLen)
-			lines.SetRow(e.RowIndex, slices.Insert((*lines)[e.RowIndex], e.ColIndex, b...))
+			lines.SetRow(e.RowIndex, slices.Insert(lines.Row(e.RowIndex).Bytes(), e.ColIndex, b...))
 
 			//verb.PP("'%s'", string((*lines)[e.RowIndex]))
 			e.ColIndex += bLen
@@ -1307,7 +3714,7 @@ func (e *Editor) getColumnIndexClosestToCursorXPosition(rowIndex, indexOfLogical
 	bo := e.bsArray.Boundary(rowIndex, indexOfLogicalRow)
 	// bo := e.bsay[rowIndex].boundaries[indexOfLogicalRow]
 	// Get the line content for the specified rowIndex.
-	row := &(*e.Rows())[rowIndex]
+	row := e.Rows().Row(rowIndex)
 	// Initialize colIndex to the start index of the logical row.
 	for colIndex = bo.StartIndex; ; {
 		// Decode the next rune starting from colIndex.